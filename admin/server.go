@@ -0,0 +1,256 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/baidu/conf-agent/conf_reload"
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+// Server is the admin http server of agent
+type Server struct {
+	addr string
+	srv  *http.Server
+
+	// token is required by write requests, empty means only loopback clients can write
+	token string
+
+	// freezeFile is the marker file which freezes all reloaders
+	freezeFile string
+
+	reloaders []*conf_reload.Reloader
+}
+
+func NewServer(addr string, token string, freezeFile string, reloaders []*conf_reload.Reloader) *Server {
+	server := &Server{
+		addr:       addr,
+		token:      token,
+		freezeFile: freezeFile,
+		reloaders:  reloaders,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", server.handleStatus)
+	mux.HandleFunc("/freeze", server.handleFreeze)
+	mux.HandleFunc("/unfreeze", server.handleFreeze)
+	mux.HandleFunc("/reloaders/", server.handleReloader)
+	mux.Handle("/metrics", metrics.Handler())
+
+	server.srv = &http.Server{
+		Handler: mux,
+	}
+
+	return server
+}
+
+// Start listens on addr and serves in background
+func (server *Server) Start() error {
+	ln, err := net.Listen("tcp", server.addr)
+	if err != nil {
+		return fmt.Errorf("admin server listen fail, addr: %s, err: %v", server.addr, err)
+	}
+
+	go func() {
+		if err := server.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			xlog.Default.Error(fmt.Sprintf("admin server serve fail, err: %v", err))
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts down the server gracefully
+func (server *Server) Stop(ctx context.Context) error {
+	return server.srv.Shutdown(ctx)
+}
+
+func (server *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+
+	statuses := []conf_reload.Status{}
+	for _, reloader := range server.reloaders {
+		statuses = append(statuses, reloader.Status())
+	}
+
+	writeJSON(w, http.StatusOK, statusResponse{Reloaders: statuses})
+}
+
+// handleFreeze freezes or unfreezes all reloaders by marker file:
+//   POST /freeze?reason={reason}
+//   POST /unfreeze
+func (server *Server) handleFreeze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	if !server.authorized(r) {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "forbidden"})
+		return
+	}
+
+	var err error
+	if r.URL.Path == "/freeze" {
+		err = conf_reload.FreezeByFile(server.freezeFile, r.URL.Query().Get("reason"))
+	} else {
+		err = conf_reload.UnfreezeByFile(server.freezeFile)
+	}
+	if err != nil {
+		xlog.Default.Error(fmt.Sprintf("admin server %s fail, err: %v", r.URL.Path, err))
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+
+	xlog.Default.Info(fmt.Sprintf("admin server %s succ, file: %s", r.URL.Path, server.freezeFile))
+	writeJSON(w, http.StatusOK, errorResponse{})
+}
+
+// handleReloader serves requests of a reloader:
+//   GET  /reloaders/{name}/versions
+//   POST /reloaders/{name}/rollback?version={version}
+//   POST /reloaders/{name}/unpin
+//   POST /reloaders/{name}/freeze?reason={reason}
+//   POST /reloaders/{name}/unfreeze
+func (server *Server) handleReloader(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/reloaders/"), "/"), "/")
+	if len(parts) != 2 {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	reloader := server.reloader(name)
+	if reloader == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("reloader %s not exist", name)})
+		return
+	}
+
+	method := http.MethodPost
+	if action == "versions" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		return
+	}
+	if method == http.MethodPost && !server.authorized(r) {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: "forbidden"})
+		return
+	}
+
+	ctx := xlog.NewContext(context.Background(), reloader.Name)
+	switch action {
+	case "versions":
+		versions, err := reloader.Versions()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+
+	case "rollback":
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "version is required"})
+			return
+		}
+		if err := reloader.Rollback(ctx, version); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, errorResponse{})
+
+	case "unpin":
+		if err := reloader.Unpin(ctx); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, errorResponse{})
+
+	case "freeze":
+		if err := reloader.Freeze(ctx, r.URL.Query().Get("reason")); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, errorResponse{})
+
+	case "unfreeze":
+		if err := reloader.Unfreeze(ctx); err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, errorResponse{})
+
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "not found"})
+	}
+}
+
+// authorized checks whether a write request is allowed.
+// If token is set, request must carry it in X-Admin-Token header, otherwise request must come from loopback address.
+func (server *Server) authorized(r *http.Request) bool {
+	if server.token != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(server.token)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *Server) reloader(name string) *conf_reload.Reloader {
+	for _, reloader := range server.reloaders {
+		if reloader.Name == name {
+			return reloader
+		}
+	}
+
+	return nil
+}
+
+type statusResponse struct {
+	Reloaders []conf_reload.Status
+}
+
+type errorResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	bs, err := json.Marshal(data)
+	if err != nil {
+		code = http.StatusInternalServerError
+		bs = []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(bs)
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/conf_reload"
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xfile"
+)
+
+// confServer serves conf API of task a.data and reload API of bfe
+type confServer struct {
+	lock sync.Mutex
+	// version is the newer version of a.data, "" means no update
+	version string
+	// fail makes conf API reply 500
+	fail bool
+}
+
+func (s *confServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case r.URL.Path == "/reload":
+		fmt.Fprint(w, `{"error": null}`)
+	case s.fail:
+		w.WriteHeader(http.StatusInternalServerError)
+	case s.version == "":
+		fmt.Fprint(w, `{"ErrNum": 200, "Data": null}`)
+	default:
+		fmt.Fprintf(w, `{"ErrNum": 200, "Data": {"Version": "%s"}}`, s.version)
+	}
+}
+
+func (s *confServer) set(version string, fail bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.version, s.fail = version, fail
+}
+
+// newTestServer returns admin server of reloader "test", whose ConfDir links to version 2 and retains version 1
+func newTestServer(t *testing.T, conf *confServer) *Server {
+	server := httptest.NewServer(conf)
+	t.Cleanup(server.Close)
+
+	root := t.TempDir()
+	confDir := filepath.Join(root, "conf")
+	for _, version := range []string{"1", "2"} {
+		if err := xfile.FileOverwrite(confDir+"_"+version+"/a.data", []byte(`{"Version": "`+version+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(confDir+"_2", confDir); err != nil {
+		t.Fatal(err)
+	}
+
+	reloader, err := conf_reload.NewReloader(&config.ReloaderConfig{
+		Name:           "test",
+		ConfDir:        confDir,
+		ReloadInterval: time.Hour,
+		Trigger: config.TriggerConfig{
+			BFEReloadAPI:     server.URL + "/reload",
+			BFEReloadTimeout: time.Second,
+			ConfDir:          confDir,
+		},
+		ConfFiles:          []string{"a.data"},
+		RetainVersionCount: 5,
+		NormalFileTasks: []*config.NormalFileTaskConfig{{
+			ConfDir:         confDir,
+			ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+			ConfAPI:         "/conf",
+			ConfFileName:    "a.data",
+			ConfTaskTimeout: time.Second,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewServer("", "", filepath.Join(root, "agent.freeze"), []*conf_reload.Reloader{reloader})
+}
+
+// serve sends request from loopback address to server, decodes json response into v if it's not nil
+func serve(t *testing.T, server *Server, method, target string, v interface{}) int {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = "127.0.0.1:10000"
+	w := httptest.NewRecorder()
+	server.srv.Handler.ServeHTTP(w, r)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: decode %s fail, err: %v", method, target, w.Body.String(), err)
+		}
+	}
+
+	return w.Code
+}
+
+func TestHandleReloader(t *testing.T) {
+	server := newTestServer(t, &confServer{})
+
+	assertVersions := func(want conf_reload.VersionList) {
+		t.Helper()
+		var got conf_reload.VersionList
+		if code := serve(t, server, http.MethodGet, "/reloaders/test/versions", &got); code != http.StatusOK {
+			t.Fatalf("versions: got code %d", code)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("versions = %+v, want %+v", got, want)
+		}
+	}
+	assertVersions(conf_reload.VersionList{Name: "test", Current: "2", Versions: []string{"2", "1"}})
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{method: http.MethodGet, target: "/reloaders/unknown/versions", code: http.StatusNotFound},
+		{method: http.MethodGet, target: "/reloaders/test", code: http.StatusNotFound},
+		{method: http.MethodGet, target: "/reloaders/test/restart", code: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/reloaders/test/restart", code: http.StatusNotFound},
+		{method: http.MethodPost, target: "/reloaders/test/versions", code: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, target: "/reloaders/test/rollback?version=1", code: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, target: "/reloaders/test/rollback", code: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/reloaders/test/rollback?version=3", code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		var rsp errorResponse
+		if code := serve(t, server, tt.method, tt.target, &rsp); code != tt.code || rsp.Error == "" {
+			t.Errorf("%s %s: got code %d error %q, want code %d with error", tt.method, tt.target, code, rsp.Error, tt.code)
+		}
+	}
+	// failed requests change nothing
+	assertVersions(conf_reload.VersionList{Name: "test", Current: "2", Versions: []string{"2", "1"}})
+
+	if code := serve(t, server, http.MethodPost, "/reloaders/test/rollback?version=1", nil); code != http.StatusOK {
+		t.Fatalf("rollback: got code %d", code)
+	}
+	assertVersions(conf_reload.VersionList{Name: "test", Current: "1", Pinned: "1", Versions: []string{"2", "1"}})
+
+	if code := serve(t, server, http.MethodPost, "/reloaders/test/unpin", nil); code != http.StatusOK {
+		t.Fatalf("unpin: got code %d", code)
+	}
+	assertVersions(conf_reload.VersionList{Name: "test", Current: "1", Versions: []string{"2", "1"}})
+}
+
+func TestAuthorized(t *testing.T) {
+	server := newTestServer(t, &confServer{})
+
+	tests := []struct {
+		name       string
+		token      string
+		remoteAddr string
+		header     string
+		code       int
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:10000", code: http.StatusOK},
+		{name: "loopback_ipv6", remoteAddr: "[::1]:10000", code: http.StatusOK},
+		{name: "remote", remoteAddr: "10.0.0.1:10000", code: http.StatusForbidden},
+		{name: "token", token: "secret", remoteAddr: "10.0.0.1:10000", header: "secret", code: http.StatusOK},
+		{name: "token_missing", token: "secret", remoteAddr: "127.0.0.1:10000", code: http.StatusForbidden},
+		{name: "token_wrong", token: "secret", remoteAddr: "10.0.0.1:10000", header: "wrong", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.token = tt.token
+
+			for _, target := range []string{"/unfreeze", "/reloaders/test/unpin"} {
+				r := httptest.NewRequest(http.MethodPost, target, nil)
+				r.RemoteAddr = tt.remoteAddr
+				if tt.header != "" {
+					r.Header.Set("X-Admin-Token", tt.header)
+				}
+				w := httptest.NewRecorder()
+				server.srv.Handler.ServeHTTP(w, r)
+				if w.Code != tt.code {
+					t.Errorf("POST %s: got code %d, want %d", target, w.Code, tt.code)
+				}
+			}
+
+			// read requests are not limited
+			r := httptest.NewRequest(http.MethodGet, "/reloaders/test/versions", nil)
+			r.RemoteAddr = "10.0.0.1:10000"
+			w := httptest.NewRecorder()
+			server.srv.Handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("GET versions: got code %d, want 200", w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	conf := &confServer{}
+	server := newTestServer(t, conf)
+	reloader := server.reloaders[0]
+
+	// status decodes response of /status, fields are checked by name so renaming breaks the test
+	status := func() map[string]interface{} {
+		t.Helper()
+		var rsp struct {
+			Reloaders []map[string]interface{}
+		}
+		if code := serve(t, server, http.MethodGet, "/status", &rsp); code != http.StatusOK {
+			t.Fatalf("status: got code %d", code)
+		}
+		if len(rsp.Reloaders) != 1 {
+			t.Fatalf("got %d reloaders, want 1", len(rsp.Reloaders))
+		}
+		return rsp.Reloaders[0]
+	}
+	assertFields := func(got map[string]interface{}, want map[string]interface{}) {
+		t.Helper()
+		for key, value := range want {
+			if !reflect.DeepEqual(got[key], value) {
+				t.Errorf("%s = %#v, want %#v", key, got[key], value)
+			}
+		}
+	}
+
+	if code := serve(t, server, http.MethodPost, "/status", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status: got code %d, want 405", code)
+	}
+
+	// no cycle yet
+	got := status()
+	for _, key := range []string{"Name", "LastCycleTime", "Outcome", "Version", "Pinned", "Frozen",
+		"AvailableVersion", "LastError", "LastErrorTime", "ConsecutiveFailures", "Breakers"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("status has no field %s: %v", key, got)
+		}
+	}
+	assertFields(got, map[string]interface{}{
+		"Name":                "test",
+		"Outcome":             "",
+		"Version":             "2",
+		"LastError":           "",
+		"ConsecutiveFailures": float64(0),
+	})
+
+	// failures are counted
+	conf.set("", true)
+	for i := 0; i < 2; i++ {
+		if err := reloader.SyncOnce(context.Background()); err == nil {
+			t.Fatal("SyncOnce() error = nil, want probe error")
+		}
+	}
+	got = status()
+	assertFields(got, map[string]interface{}{
+		"Outcome":             "probe_failed",
+		"Version":             "2",
+		"ConsecutiveFailures": float64(2),
+	})
+	lastError, _ := got["LastError"].(string)
+	if !strings.Contains(lastError, "500") {
+		t.Errorf("LastError = %q, want error of code 500", lastError)
+	}
+	lastErrorTime, err := time.Parse(time.RFC3339Nano, got["LastErrorTime"].(string))
+	if err != nil || time.Since(lastErrorTime) > time.Minute {
+		t.Errorf("LastErrorTime = %v, want now", got["LastErrorTime"])
+	}
+
+	// succ cycle resets failures, last error is kept
+	conf.set("3", false)
+	if err := reloader.SyncOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertFields(status(), map[string]interface{}{
+		"Outcome":             "updated",
+		"Version":             "3",
+		"LastError":           lastError,
+		"LastErrorTime":       got["LastErrorTime"],
+		"ConsecutiveFailures": float64(0),
+	})
+}
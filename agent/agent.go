@@ -15,24 +15,52 @@
 package agent
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baidu/conf-agent/admin"
+	"github.com/baidu/conf-agent/conf_push"
 	"github.com/baidu/conf-agent/conf_reload"
 	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xhttp"
+	"github.com/baidu/conf-agent/xlog"
 )
 
 // The Agent keep reloaders.
 // Agent Start will start all reloaders
 type Agent struct {
-	stop chan bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// stopTimeout is the max time Stop waits for in-progress reload cycles
+	stopTimeout time.Duration
 
 	reloaders []*conf_reload.Reloader
+
+	// adminServer is nil if admin server is disabled
+	adminServer *admin.Server
+
+	// subscriber is nil if push is disabled
+	subscriber *conf_push.Subscriber
 }
 
 // New create a Agent according to config
-func New(rcs []*config.ReloaderConfig) (*Agent, error) {
+func New(c *config.Config) (*Agent, error) {
+	xhttp.SetIdentity(c.Agent.Identity)
+
+	ctx, cancel := context.WithCancel(context.Background())
 	agent := &Agent{
-		stop: make(chan bool),
+		ctx:    ctx,
+		cancel: cancel,
+
+		stopTimeout: c.Agent.StopTimeout,
 	}
-	for _, mc := range rcs {
+	for _, mc := range c.Reloaders {
 		m, err := conf_reload.NewReloader(mc)
 		if err != nil {
 			return nil, err
@@ -41,17 +69,140 @@ func New(rcs []*config.ReloaderConfig) (*Agent, error) {
 		agent.reloaders = append(agent.reloaders, m)
 	}
 
+	if c.Agent.AdminAddr != "" {
+		agent.adminServer = admin.NewServer(c.Agent.AdminAddr, c.Agent.AdminToken, c.Agent.FreezeFile, agent.reloaders)
+	}
+
+	if c.Agent.Push.PushAPI != "" {
+		subscriber, err := conf_push.NewSubscriber(c.Agent.Push, agent.kick)
+		if err != nil {
+			return nil, err
+		}
+		agent.subscriber = subscriber
+	}
+
 	return agent, nil
 }
 
-func (agent *Agent) Start() {
+// Reloader returns the reloader by name
+func (agent *Agent) Reloader(name string) (*conf_reload.Reloader, error) {
 	for _, reloader := range agent.reloaders {
-		go reloader.Start()
+		if reloader.Name == name {
+			return reloader, nil
+		}
 	}
 
-	<-agent.stop
+	return nil, fmt.Errorf("reloader %s not exist", name)
 }
 
-func (agent *Agent) Stop() {
-	agent.stop <- true
+// kick makes the reloader run a reload cycle at once, unknown reloader is ignored
+func (agent *Agent) kick(name string) {
+	reloader, err := agent.Reloader(name)
+	if err != nil {
+		xlog.Default.Info(xlog.InfoLogFormat(context.Background(), "kick", err.Error()))
+		return
+	}
+
+	reloader.Kick()
+}
+
+// Start starts admin server and all reloaders, blocks until Stop is called
+func (agent *Agent) Start() error {
+	if agent.adminServer != nil {
+		if err := agent.adminServer.Start(); err != nil {
+			return err
+		}
+	}
+
+	for _, reloader := range agent.reloaders {
+		agent.wg.Add(1)
+		go func(reloader *conf_reload.Reloader) {
+			defer agent.wg.Done()
+			reloader.Start(agent.ctx)
+		}(reloader)
+	}
+
+	if agent.subscriber != nil {
+		agent.wg.Add(1)
+		go func() {
+			defer agent.wg.Done()
+			agent.subscriber.Start(agent.ctx)
+		}()
+	}
+
+	<-agent.ctx.Done()
+	return nil
+}
+
+// RunOnce runs a reload cycle of every reloader without triggering bfe reload, then returns.
+// It returns error if any reloader failed.
+func (agent *Agent) RunOnce() error {
+	errs := make([]error, len(agent.reloaders))
+
+	var wg sync.WaitGroup
+	for i, reloader := range agent.reloaders {
+		wg.Add(1)
+		go func(i int, reloader *conf_reload.Reloader) {
+			defer wg.Done()
+			errs[i] = reloader.SyncOnce(xlog.NewContext(context.Background(), reloader.Name))
+		}(i, reloader)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", agent.reloaders[i].Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("reloaders fail, %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// DryRun writes what every reloader would change to w, without storing files or triggering bfe reload.
+// It returns error if any reloader failed.
+func (agent *Agent) DryRun(w io.Writer) error {
+	failed := []string{}
+	for _, reloader := range agent.reloaders {
+		if err := reloader.DryRun(xlog.NewContext(context.Background(), reloader.Name), w); err != nil {
+			fmt.Fprintf(w, "# reloader %s: fail, err: %v\n", reloader.Name, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", reloader.Name, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("reloaders fail, %s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+// Stop stops all reloaders, in-progress reload cycles are waited up to stopTimeout
+func (agent *Agent) Stop() error {
+	agent.cancel()
+
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), agent.stopTimeout)
+	defer cancel()
+
+	if agent.adminServer != nil {
+		if err := agent.adminServer.Stop(timeoutCtx); err != nil {
+			xlog.Default.Error(fmt.Sprintf("admin server stop fail, err: %v", err))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		agent.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-timeoutCtx.Done():
+		return fmt.Errorf("wait reloaders stop timeout after %s", agent.stopTimeout)
+	}
 }
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+// newReloaderConfig returns config of reloader with a task a.data requesting /{name} of server
+func newReloaderConfig(t *testing.T, name string, server *httptest.Server) *config.ReloaderConfig {
+	confDir := filepath.Join(t.TempDir(), name)
+
+	return &config.ReloaderConfig{
+		Name:           name,
+		ConfDir:        confDir,
+		ReloadInterval: time.Hour,
+		Trigger: config.TriggerConfig{
+			BFEReloadAPI:     server.URL + "/reload",
+			BFEReloadTimeout: time.Second,
+			ConfDir:          confDir,
+		},
+		ConfFiles: []string{"a.data"},
+		NormalFileTasks: []*config.NormalFileTaskConfig{{
+			ConfDir:         confDir,
+			ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+			ConfAPI:         "/" + name,
+			ConfFileName:    "a.data",
+			ConfTaskTimeout: time.Second,
+		}},
+	}
+}
+
+func TestAgentRunOnce(t *testing.T) {
+	reloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good":
+			fmt.Fprint(w, `{"ErrNum": 200, "Data": {"Version": "1"}}`)
+		case "/reload":
+			reloads++
+			fmt.Fprint(w, `{"error": null}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	good := newReloaderConfig(t, "good", server)
+	agent, err := New(&config.Config{
+		Agent:     &config.AgentConfig{},
+		Reloaders: []*config.ReloaderConfig{good, newReloaderConfig(t, "bad", server)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = agent.RunOnce()
+	if err == nil {
+		t.Fatal("RunOnce() error = nil, want error of reloader bad")
+	}
+	if !strings.Contains(err.Error(), "bad: ") || strings.Contains(err.Error(), "good: ") {
+		t.Errorf("RunOnce() error = %v, want only reloader bad failed", err)
+	}
+
+	// reloader good is synced even if reloader bad failed
+	bs, err := ioutil.ReadFile(filepath.Join(good.ConfDir, "a.data"))
+	if err != nil || string(bs) != `{"Version": "1"}` {
+		t.Errorf("a.data of good = %s, err = %v", bs, err)
+	}
+	if reloads != 0 {
+		t.Errorf("bfe reloaded %d times, want 0", reloads)
+	}
+}
+
+// blockingServer holds conf API requests until release is closed
+func blockingServer(started chan<- struct{}, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reload" {
+			fmt.Fprint(w, `{"error": null}`)
+			return
+		}
+
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		fmt.Fprint(w, `{"ErrNum": 200, "Data": {"Version": "1"}}`)
+	}))
+}
+
+// startAgent starts agent with a reloader requesting server, returns after the first request is received
+func startAgent(t *testing.T, server *httptest.Server, started <-chan struct{}, stopTimeout time.Duration) (*Agent, *config.ReloaderConfig) {
+	rc := newReloaderConfig(t, "test", server)
+	// run the first cycle at once
+	rc.ReloadInterval = time.Millisecond
+	rc.NormalFileTasks[0].ConfTaskTimeout = time.Minute
+
+	agent, err := New(&config.Config{
+		Agent:     &config.AgentConfig{StopTimeout: stopTimeout},
+		Reloaders: []*config.ReloaderConfig{rc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go agent.Start()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload cycle not started")
+	}
+
+	return agent, rc
+}
+
+func TestAgentStopDrain(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	server := blockingServer(started, release)
+	defer server.Close()
+
+	agent, rc := startAgent(t, server, started, 5*time.Second)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- agent.Stop()
+	}()
+
+	// in-flight cycle is waited
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop() = %v before in-flight cycle finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Stop() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() not returned after cycle finished")
+	}
+
+	// the cycle is completed rather than interrupted
+	bs, err := ioutil.ReadFile(filepath.Join(rc.ConfDir, "a.data"))
+	if err != nil || string(bs) != `{"Version": "1"}` {
+		t.Errorf("a.data = %s, err = %v", bs, err)
+	}
+}
+
+func TestAgentStopTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	server := blockingServer(started, release)
+	defer server.Close()
+
+	agent, _ := startAgent(t, server, started, 50*time.Millisecond)
+	// reloaders must exit before temp dir is removed
+	defer agent.wg.Wait()
+	defer close(release)
+
+	begin := time.Now()
+	err := agent.Stop()
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Stop() error = %v, want timeout", err)
+	}
+	if cost := time.Since(begin); cost > 5*time.Second {
+		t.Errorf("Stop() cost %s, want about 50ms", cost)
+	}
+}
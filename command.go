@@ -0,0 +1,84 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/baidu/conf-agent/agent"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+const commandUsage = `commands:
+  versions <reloader>            list retained versions of reloader
+  rollback <reloader> <version>  reload bfe with a retained version and pin reloader to it
+  unpin    <reloader>            let reloader roll forward again`
+
+// runCommand runs subcommand in args, output is written to w
+func runCommand(agent *agent.Agent, args []string, w io.Writer) error {
+	usageErr := fmt.Errorf("bad command: %s\n%s", strings.Join(args, " "), commandUsage)
+
+	want := map[string]int{"versions": 2, "rollback": 3, "unpin": 2}
+	if n, ok := want[args[0]]; !ok || len(args) != n {
+		return usageErr
+	}
+
+	reloader, err := agent.Reloader(args[1])
+	if err != nil {
+		return err
+	}
+	ctx := xlog.NewContext(context.Background(), reloader.Name)
+
+	switch args[0] {
+	case "versions":
+		versions, err := reloader.Versions()
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions.Versions {
+			flags := []string{}
+			if version == versions.Current {
+				flags = append(flags, "current")
+			}
+			if version == versions.Pinned {
+				flags = append(flags, "pinned")
+			}
+
+			if len(flags) > 0 {
+				fmt.Fprintf(w, "%s (%s)\n", version, strings.Join(flags, ", "))
+			} else {
+				fmt.Fprintln(w, version)
+			}
+		}
+
+	case "rollback":
+		if err := reloader.Rollback(ctx, args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reloader %s rolled back to %s and pinned\n", reloader.Name, args[2])
+
+	case "unpin":
+		if err := reloader.Unpin(ctx); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "reloader %s unpinned\n", reloader.Name)
+	}
+
+	return nil
+}
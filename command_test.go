@@ -0,0 +1,101 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/agent"
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xfile"
+)
+
+func Test_runCommand(t *testing.T) {
+	bfe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"error": null}`)
+	}))
+	defer bfe.Close()
+
+	// conf links to version 2 and version 1 is retained
+	confDir := filepath.Join(t.TempDir(), "conf")
+	for _, version := range []string{"1", "2"} {
+		if err := xfile.FileOverwrite(confDir+"_"+version+"/a.data", []byte(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(confDir+"_2", confDir); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := agent.New(&config.Config{
+		Agent: &config.AgentConfig{},
+		Reloaders: []*config.ReloaderConfig{{
+			Name:           "test",
+			ConfDir:        confDir,
+			ReloadInterval: time.Hour,
+			Trigger: config.TriggerConfig{
+				BFEReloadAPI:     bfe.URL + "/reload",
+				BFEReloadTimeout: time.Second,
+				ConfDir:          confDir,
+			},
+			RetainVersionCount: 5,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args    string
+		want    string
+		wantErr string
+	}{
+		{args: "versions test", want: "2 (current)\n1\n"},
+		{args: "versions", wantErr: "bad command"},
+		{args: "rollback test", wantErr: "bad command"},
+		{args: "restart test", wantErr: "bad command"},
+		{args: "versions unknown", wantErr: "reloader unknown not exist"},
+		{args: "rollback test 3", wantErr: "not retained"},
+		{args: "rollback test 1", want: "reloader test rolled back to 1 and pinned\n"},
+		{args: "versions test", want: "2\n1 (current, pinned)\n"},
+		{args: "unpin test", want: "reloader test unpinned\n"},
+		{args: "versions test", want: "2\n1 (current)\n"},
+	}
+	for _, tt := range tests {
+		var w bytes.Buffer
+		err := runCommand(a, strings.Fields(tt.args), &w)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("runCommand(%s) error = %v, want %s", tt.args, err, tt.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("runCommand(%s) error = %v", tt.args, err)
+		}
+		if w.String() != tt.want {
+			t.Errorf("runCommand(%s) = %q, want %q", tt.args, w.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_push
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xbackoff"
+	"github.com/baidu/conf-agent/xhttp"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+// Subscriber subscribes SSE API of conf server, every event announces a reloader having newer version,
+// data of event is the reloader name, such as "data: server_data_conf".
+type Subscriber struct {
+	config config.PushConfig
+
+	// confServer selects endpoint of conf server for connections
+	confServer *xhttp.EndpointPool
+	// transport connects conf server with http client options of Basic
+	transport *xhttp.Transport
+
+	// notify is called with reloader name of every event
+	notify func(reloader string)
+}
+
+func NewSubscriber(c config.PushConfig, notify func(reloader string)) (*Subscriber, error) {
+	transport, err := xhttp.GetTransport(c.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscriber{
+		config: c,
+		notify: notify,
+
+		confServer: xhttp.NewEndpointPool(c.ConfServer.Endpoints, c.ConfServer.Strategy, c.ConfServer.Cooldown),
+		transport:  transport,
+	}, nil
+}
+
+// Start subscribes until ctx is done.
+// If stream drops, it reconnects with backoff, which doubles from ReconnectMin to ReconnectMax
+// and is reset once connected.
+func (s *Subscriber) Start(ctx context.Context) {
+	// requests of push don't belong to any reloader
+	ctx = xlog.NewContext(ctx, "")
+
+	backoff := xbackoff.Backoff{
+		Min:        s.config.ReconnectMin,
+		Max:        s.config.ReconnectMax,
+		Multiplier: 2,
+	}
+
+	failures := 0
+	for {
+		connected, err := s.subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			failures = 0
+		}
+		failures++
+
+		delay := backoff.Delay(failures)
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "push.subscribe", fmt.Errorf("%v, reconnect after %s", err, delay)))
+
+		if !xbackoff.Sleep(ctx, delay) {
+			return
+		}
+	}
+}
+
+// subscribe connects push API and reads events until stream drops.
+// It returns true if connected.
+func (s *Subscriber) subscribe(ctx context.Context) (bool, error) {
+	params := url.Values{}
+	params.Add("bfe_cluster", s.config.BFECluster)
+	requestURL := s.config.PushAPI + "?" + params.Encode()
+
+	req := xhttp.NewHTTPRequest().
+		Decorate(
+			xhttp.HTTPRequestContextOp(ctx),
+			// stream is closed by ctx
+			xhttp.HTTPRequestTimeoutOp(0),
+			xhttp.SimpleRequestOp(http.MethodGet, requestURL, nil),
+			xhttp.HTTPRequestEndpointOp(s.confServer),
+			xhttp.HTTPRequestTransportOp(s.transport),
+			xhttp.HTTPRequestHeaderOp(s.config.Headers),
+			// events are read from raw body
+			xhttp.HTTPRequestHeaderOp(map[string]string{"Accept": "text/event-stream", "Accept-Encoding": "identity"})).
+		Do()
+	if err := req.Err(); err != nil {
+		return false, err
+	}
+	defer req.Response.Body.Close()
+
+	if err := req.Decorate(xhttp.RspCode200Op).Err(); err != nil {
+		return false, err
+	}
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "push.subscribe", "connected, url: ", req.Request.URL.String()))
+
+	err := readEvents(req.Response.Body, func(data string) {
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "push.subscribe", "newer version of reloader ", data))
+		s.notify(data)
+	})
+	if err == nil {
+		err = fmt.Errorf("stream closed")
+	}
+
+	return true, err
+}
+
+// readEvents reads SSE stream, calls handle with data of every event
+func readEvents(r io.Reader, handle func(data string)) error {
+	scanner := bufio.NewScanner(r)
+
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// blank line dispatches the event
+		if line == "" {
+			if len(data) > 0 {
+				handle(strings.Join(data, "\n"))
+			}
+			data = data[:0]
+			continue
+		}
+
+		// comment, usually used as keepalive
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		if field == "data" {
+			data = append(data, value)
+		}
+	}
+
+	return scanner.Err()
+}
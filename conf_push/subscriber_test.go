@@ -0,0 +1,152 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_push
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xhttp"
+)
+
+func Test_readEvents(t *testing.T) {
+	stream := ": keepalive\n\n" +
+		"event: update\ndata: tls\n\n" +
+		"data:server_data_conf\n\n" +
+		"id: 3\n\n" +
+		"data: a\ndata: b\n\n" +
+		"data: not_dispatched"
+
+	got := []string{}
+	if err := readEvents(strings.NewReader(stream), func(data string) {
+		got = append(got, data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"tls", "server_data_conf", "a\nb"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readEvents() = %q, want %q", got, want)
+	}
+}
+
+func TestSubscriberReconnect(t *testing.T) {
+	var lock sync.Mutex
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		connections++
+		lock.Unlock()
+
+		if r.URL.Query().Get("bfe_cluster") != "cluster" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// stream drops after an event
+		fmt.Fprint(w, "data: tls\n\n")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notified := make(chan string, 10)
+	s, err := NewSubscriber(config.PushConfig{
+		ConfServer:   config.EndpointConfig{Endpoints: []string{server.URL}},
+		PushAPI:      "/push",
+		BFECluster:   "cluster",
+		ReconnectMin: time.Millisecond,
+		ReconnectMax: 10 * time.Millisecond,
+	}, func(reloader string) {
+		notified <- reloader
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case reloader := <-notified:
+			if reloader != "tls" {
+				t.Errorf("got reloader %s, want tls", reloader)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("event not received")
+		}
+	}
+
+	cancel()
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	if connections < 2 {
+		t.Errorf("got %d connections, want reconnect", connections)
+	}
+}
+
+func TestSubscriberIdentityHeaders(t *testing.T) {
+	prev := xhttp.Identity()
+	xhttp.SetIdentity(config.IdentityConfig{RequestIDHeader: "X-Request-Id", ReloaderHeader: "X-Conf-Agent-Reloader"})
+	defer xhttp.SetIdentity(prev)
+
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case headers <- r.Header:
+		default:
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewSubscriber(config.PushConfig{
+		ConfServer:   config.EndpointConfig{Endpoints: []string{server.URL}},
+		PushAPI:      "/push",
+		ReconnectMin: time.Hour,
+		ReconnectMax: time.Hour,
+	}, func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start(ctx)
+
+	select {
+	case header := <-headers:
+		if header.Get("X-Request-Id") == "" {
+			t.Errorf("X-Request-Id not sent")
+		}
+		// push doesn't belong to any reloader
+		if _, ok := header["X-Conf-Agent-Reloader"]; ok {
+			t.Errorf("got X-Conf-Agent-Reloader %q, want not sent", header.Get("X-Conf-Agent-Reloader"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("push request not received")
+	}
+}
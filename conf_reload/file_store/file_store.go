@@ -15,10 +15,15 @@
 package file_store
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/baidu/conf-agent/xfile"
 	"github.com/baidu/conf-agent/xlog"
@@ -29,6 +34,17 @@ type FileStore struct {
 	ConfDir string
 	// CoypFiles is list of files and directories copied from default dir to tmp dir
 	CopyFiles []string
+	// Retention decides which version directories are kept
+	Retention RetentionPolicy
+}
+
+// RetentionPolicy decides which {ConfDir}_{version} directories are kept.
+// The directory ConfDir links to is always kept.
+type RetentionPolicy struct {
+	// Count is the count of newest versions kept, including the current one
+	Count int
+	// MaxAge keeps versions modified within MaxAge, 0 means disabled
+	MaxAge time.Duration
 }
 
 // compose path of tempory directory to store files
@@ -36,51 +52,267 @@ func (fileStore *FileStore) tmpDir(version string) string {
 	return fileStore.ConfDir + "_" + version
 }
 
-func NewFileStore(confDir string, copyFiles []string) (*FileStore, error) {
+// CurrentVersion returns the version ConfDir links to
+// return "" if ConfDir is not a link to a version directory
+func (fileStore *FileStore) CurrentVersion() (string, error) {
+	dest, err := filepath.EvalSymlinks(fileStore.ConfDir)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := filepath.Base(fileStore.ConfDir) + "_"
+	if base := filepath.Base(dest); dest != fileStore.ConfDir && strings.HasPrefix(base, prefix) {
+		return strings.TrimPrefix(base, prefix), nil
+	}
+
+	return "", nil
+}
+
+func NewFileStore(confDir string, copyFiles []string, retention RetentionPolicy) (*FileStore, error) {
 	return &FileStore{
 		ConfDir:   confDir,
 		CopyFiles: copyFiles,
+		Retention: retention,
 	}, nil
 }
 
+// originVersion is the version of ConfDir if it's not a link file,
+// such as conf dir of bfe package before agent first updates it
+const originVersion = "0"
+
 // UpdateDefaultConfDir updates default config directory with config files in tempory directory.
+// ConfDir is switched to the new link by rename(2), so it always links to a complete version,
+// old versions are pruned according to retention policy only after the switch succeeded.
 func (fileStore *FileStore) UpdateDefaultConfDir(ctx context.Context, version string) error {
-	dest, err := filepath.EvalSymlinks(fileStore.ConfDir)
-	if err != nil {
+	confDir := fileStore.ConfDir
+
+	// ConfDir not exist at the first time, just link it
+	dest, err := filepath.EvalSymlinks(confDir)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	if err := os.RemoveAll(fileStore.ConfDir); err != nil {
-		err = fmt.Errorf("file: %s, err: %v", fileStore.ConfDir, err)
-		xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir.Remove", err))
+	// a directory can't be replaced by rename(2), move it to ModDemo_0 and link ModDemo at once,
+	// ModDemo only disappears between the two rename(2)
+	origin := ""
+	if dest == confDir {
+		origin = fileStore.tmpDir(originVersion)
+		if err := os.Rename(confDir, origin); err != nil {
+			err = fmt.Errorf("rename fail, oldPath: %s, newPath: %s, err: %v", confDir, origin, err)
+			xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir.Rename", err))
+			return err
+		}
+	}
 
+	// ln -sf ModDemo_{version} ModDemo.tmp_link_xxx && mv ModDemo.tmp_link_xxx ModDemo
+	target := fileStore.tmpDir(version)
+	if err := xfile.FileLinkAtomic(target, confDir); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir.FileLinkAtomic", err))
+		// move the directory back, so ModDemo still exists
+		if origin != "" {
+			os.Rename(origin, confDir)
+		}
 		return err
 	}
 
-	// delete the target file if it's a link file
-	if dest != fileStore.ConfDir {
-		if err := os.RemoveAll(dest); err != nil {
-			err = fmt.Errorf("file: %s, err: %v", dest, err)
-			xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir.Remove", err))
+	// delete old versions, it's ok if fail
+	fileStore.Prune(ctx)
 
-			return err
+	return nil
+}
+
+type versionDir struct {
+	path    string
+	version string
+	modTime time.Time
+}
+
+// versionDirs lists all {ConfDir}_{version} directories
+func (fileStore *FileStore) versionDirs() ([]*versionDir, error) {
+	parent, base := filepath.Split(fileStore.ConfDir)
+	infos, err := ioutil.ReadDir(filepath.Clean(parent))
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := []*versionDir{}
+	for _, info := range infos {
+		version := strings.TrimPrefix(info.Name(), base+"_")
+		if !info.IsDir() || version == info.Name() || !isVersion(version) {
+			continue
 		}
+
+		dirs = append(dirs, &versionDir{
+			path:    filepath.Join(parent, info.Name()),
+			version: version,
+			modTime: info.ModTime(),
+		})
 	}
 
-	// ln -sf ModDemo_{version} ModDemo
-	// NOTICE: if link fail, bfe can't restart automatically !!!
-	if err := xfile.FileLink(fileStore.tmpDir(version), fileStore.ConfDir); err != nil {
-		xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir.FileLink", err))
+	// newest version first
+	sort.Slice(dirs, func(i, j int) bool {
+		return compareVersion(dirs[i].version, dirs[j].version) > 0
+	})
+
+	return dirs, nil
+}
+
+func isVersion(s string) bool {
+	if s == "" {
+		return false
+	}
 
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersion compares number strings a and b
+func compareVersion(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+
+	return strings.Compare(a, b)
+}
+
+// Prune removes version directories and temporary links not kept by retention policy.
+// The directory ConfDir links to is never removed.
+func (fileStore *FileStore) Prune(ctx context.Context) error {
+	dirs, err := fileStore.versionDirs()
+	if err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.Prune", err))
 		return err
 	}
 
+	current, err := filepath.EvalSymlinks(fileStore.ConfDir)
+	if err != nil && !os.IsNotExist(err) {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.Prune", err))
+		return err
+	}
+
+	now := time.Now()
+	for i, dir := range dirs {
+		switch {
+		case current != "" && sameFile(current, dir.path):
+			continue
+		case i < fileStore.Retention.Count:
+			continue
+		case fileStore.Retention.MaxAge > 0 && now.Sub(dir.modTime) < fileStore.Retention.MaxAge:
+			continue
+		}
+
+		if err := os.RemoveAll(dir.path); err != nil {
+			err = fmt.Errorf("file: %s, err: %v", dir.path, err)
+			xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.Prune", err))
+			continue
+		}
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "fileStore.Prune", "remove ", dir.path))
+	}
+
+	// temporary links left by crashed FileLinkAtomic
+	tmpLinks, _ := filepath.Glob(fileStore.ConfDir + ".tmp_link_*")
+	for _, tmpLink := range tmpLinks {
+		os.Remove(tmpLink)
+	}
+
 	return nil
 }
 
+// Versions returns versions of all {ConfDir}_{version} directories, newest first
+func (fileStore *FileStore) Versions() ([]string, error) {
+	dirs, err := fileStore.versionDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	for _, dir := range dirs {
+		versions = append(versions, dir.version)
+	}
+
+	return versions, nil
+}
+
+// HasVersion checks whether {ConfDir}_{version} directory exists
+func (fileStore *FileStore) HasVersion(version string) bool {
+	if !isVersion(version) {
+		return false
+	}
+
+	info, err := os.Stat(fileStore.tmpDir(version))
+	return err == nil && info.IsDir()
+}
+
+// pinFile is the marker file which keeps the pinned version
+func (fileStore *FileStore) pinFile() string {
+	return fileStore.ConfDir + ".pin"
+}
+
+// Pin writes version to the pin marker file
+func (fileStore *FileStore) Pin(version string) error {
+	return xfile.FileOverwrite(fileStore.pinFile(), []byte(version))
+}
+
+// Unpin removes the pin marker file
+func (fileStore *FileStore) Unpin() error {
+	if err := os.Remove(fileStore.pinFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// PinnedVersion returns the pinned version, return "" if not pinned
+func (fileStore *FileStore) PinnedVersion() (string, error) {
+	bs, err := ioutil.ReadFile(fileStore.pinFile())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(bs)), nil
+}
+
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(aInfo, bInfo)
+}
+
+// ConfFile is a file to store, its content is in memory or on disk
+type ConfFile struct {
+	Content []byte
+	// Path is the local file holding content if it's not in memory,
+	// it's hard linked or copied to tempory directory
+	Path string
+}
+
+// content reads content of file from Path if it's not in memory
+func (file *ConfFile) content() ([]byte, error) {
+	if file.Path == "" {
+		return file.Content, nil
+	}
+
+	return ioutil.ReadFile(file.Path)
+}
+
 // StoreFile2TmpDir store all file to tempory directory
 // it will create new file or overwrite old file
-func (fileStore *FileStore) StoreFile2TmpDir(ctx context.Context, version string, files map[string][]byte) error {
+func (fileStore *FileStore) StoreFile2TmpDir(ctx context.Context, version string, files map[string]*ConfFile) error {
 	tmpDir := fileStore.tmpDir(version)
 
 	// delete tmp directory if exist
@@ -116,8 +348,16 @@ func (fileStore *FileStore) StoreFile2TmpDir(ctx context.Context, version string
 	}
 
 	// write content to file
-	for fileName, fileContent := range files {
-		if err := xfile.FileOverwrite(filepath.Join(tmpDir, fileName), fileContent); err != nil {
+	for fileName, file := range files {
+		if file.Path != "" {
+			if err := xfile.FileLinkOrCopy(file.Path, filepath.Join(tmpDir, fileName)); err != nil {
+				xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.FileLinkOrCopy", err))
+				return err
+			}
+			continue
+		}
+
+		if err := xfile.FileOverwrite(filepath.Join(tmpDir, fileName), file.Content); err != nil {
 			xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.FileOverwrite", err))
 			return err
 		}
@@ -128,3 +368,103 @@ func (fileStore *FileStore) StoreFile2TmpDir(ctx context.Context, version string
 
 	return nil
 }
+
+// FileChange is the change of a file in ConfDir
+type FileChange struct {
+	// Name is the file path relative to ConfDir
+	Name string
+	// Old is nil if file will be added
+	Old []byte
+	// New is nil if file will be removed
+	New []byte
+}
+
+// Preview compares files with ConfDir, returns the changes which
+// StoreFile2TmpDir and UpdateDefaultConfDir would make, unchanged files are excluded
+func (fileStore *FileStore) Preview(files map[string]*ConfFile) ([]*FileChange, error) {
+	changes := []*FileChange{}
+
+	for fileName, file := range files {
+		fileContent, err := file.content()
+		if err != nil {
+			return nil, err
+		}
+
+		old, err := ioutil.ReadFile(filepath.Join(fileStore.ConfDir, fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil && bytes.Equal(old, fileContent) {
+			continue
+		}
+
+		change := &FileChange{
+			Name: fileName,
+			New:  fileContent,
+		}
+		if err == nil {
+			change.Old = old
+		}
+		changes = append(changes, change)
+	}
+
+	// files neither fetched nor copied will not exist in newer version
+	root, err := filepath.EvalSymlinks(fileStore.ConfDir)
+	if os.IsNotExist(err) {
+		root = ""
+	} else if err != nil {
+		return nil, err
+	}
+
+	if root != "" {
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			fileName, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if _, ok := files[fileName]; ok || fileStore.isCopyFile(fileName) {
+				return nil
+			}
+
+			old, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, &FileChange{
+				Name: fileName,
+				Old:  old,
+			})
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes, nil
+}
+
+// isCopyFile checks whether fileName is in or under CopyFiles
+func (fileStore *FileStore) isCopyFile(fileName string) bool {
+	for _, copyFile := range fileStore.CopyFiles {
+		copyFile = filepath.Clean(copyFile)
+		if fileName == copyFile || strings.HasPrefix(fileName, copyFile+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,355 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file_store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/xfile"
+)
+
+func TestFileStore_Preview(t *testing.T) {
+	confDir := filepath.Join(t.TempDir(), "tls_conf")
+	for name, content := range map[string]string{
+		"server_cert_conf.data": "old",
+		"same.data":             "same",
+		"old.crt":               "old crt",
+		"client_ca/ca.crt":      "ca",
+	} {
+		if err := xfile.FileOverwrite(filepath.Join(confDir, name), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileStore, _ := NewFileStore(confDir, []string{"client_ca/"}, RetentionPolicy{})
+	staged := filepath.Join(t.TempDir(), "new.crt")
+	if err := xfile.FileOverwrite(staged, []byte("new crt")); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := fileStore.Preview(map[string]*ConfFile{
+		"server_cert_conf.data": {Content: []byte("new")},
+		"same.data":             {Content: []byte("same")},
+		"new.crt":               {Path: staged},
+	})
+	if err != nil {
+		t.Fatalf("Preview() error = %v", err)
+	}
+
+	want := []*FileChange{
+		{Name: "new.crt", New: []byte("new crt")},
+		{Name: "old.crt", Old: []byte("old crt")},
+		{Name: "server_cert_conf.data", Old: []byte("old"), New: []byte("new")},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Preview() = %+v, want %+v", changes, want)
+	}
+}
+
+func TestFileStore_UpdateDefaultConfDir(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// prepare creates ConfDir before update, returns the path which should be removed
+		prepare func(confDir string) (string, error)
+		version string
+	}{
+		{
+			name: "case_conf_dir_not_exist",
+			prepare: func(confDir string) (string, error) {
+				return "", xfile.FileOverwrite(confDir+"_1/a.data", []byte("1"))
+			},
+			version: "1",
+		},
+		{
+			name: "case_conf_dir_is_dir",
+			prepare: func(confDir string) (string, error) {
+				if err := xfile.FileOverwrite(confDir+"/a.data", []byte("0")); err != nil {
+					return "", err
+				}
+				return confDir + "_" + originVersion, xfile.FileOverwrite(confDir+"_1/a.data", []byte("1"))
+			},
+			version: "1",
+		},
+		{
+			name: "case_conf_dir_is_link",
+			prepare: func(confDir string) (string, error) {
+				if err := xfile.FileOverwrite(confDir+"_1/a.data", []byte("1")); err != nil {
+					return "", err
+				}
+				if err := os.Symlink(confDir+"_1", confDir); err != nil {
+					return "", err
+				}
+				return confDir + "_1", xfile.FileOverwrite(confDir+"_2/a.data", []byte("2"))
+			},
+			version: "2",
+		},
+		{
+			name: "case_same_version",
+			prepare: func(confDir string) (string, error) {
+				if err := xfile.FileOverwrite(confDir+"_1/a.data", []byte("1")); err != nil {
+					return "", err
+				}
+				return "", os.Symlink(confDir+"_1", confDir)
+			},
+			version: "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confDir := filepath.Join(t.TempDir(), "tls_conf")
+			removed, err := tt.prepare(confDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fileStore, _ := NewFileStore(confDir, nil, RetentionPolicy{})
+			if err := fileStore.UpdateDefaultConfDir(context.TODO(), tt.version); err != nil {
+				t.Fatalf("UpdateDefaultConfDir() error = %v", err)
+			}
+
+			bs, err := ioutil.ReadFile(filepath.Join(confDir, "a.data"))
+			if err != nil || string(bs) != tt.version {
+				t.Errorf("a.data = %s, err = %v, want %s", bs, err, tt.version)
+			}
+			if version, _ := fileStore.CurrentVersion(); version != tt.version {
+				t.Errorf("CurrentVersion() = %s, want %s", version, tt.version)
+			}
+			if removed != "" {
+				if _, err := os.Stat(removed); !os.IsNotExist(err) {
+					t.Errorf("%s should be removed, err = %v", removed, err)
+				}
+			}
+
+			// no temporary link left
+			matches, _ := filepath.Glob(confDir + ".tmp_link_*")
+			if len(matches) != 0 {
+				t.Errorf("temporary link left: %v", matches)
+			}
+		})
+	}
+}
+
+func TestFileStore_UpdateDefaultConfDirFromDir(t *testing.T) {
+	confDir := filepath.Join(t.TempDir(), "tls_conf")
+	if err := xfile.FileOverwrite(confDir+"/a.data", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := xfile.FileOverwrite(confDir+"_1/a.data", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// tls_conf_0 is occupied, the directory can't be moved
+	if err := xfile.FileOverwrite(confDir+"_0/b.data", nil); err != nil {
+		t.Fatal(err)
+	}
+	fileStore, _ := NewFileStore(confDir, nil, RetentionPolicy{Count: 2})
+	if err := fileStore.UpdateDefaultConfDir(context.TODO(), "1"); err == nil {
+		t.Fatal("UpdateDefaultConfDir() error = nil, want rename error")
+	}
+	if info, err := os.Lstat(confDir); err != nil || !info.IsDir() {
+		t.Fatalf("tls_conf should be kept as a directory, err = %v", err)
+	}
+
+	if err := os.RemoveAll(confDir + "_0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileStore.UpdateDefaultConfDir(context.TODO(), "1"); err != nil {
+		t.Fatalf("UpdateDefaultConfDir() error = %v", err)
+	}
+
+	// tls_conf is a link to tls_conf_1, the directory is kept as version 0
+	link, err := os.Readlink(confDir)
+	if err != nil || link != confDir+"_1" {
+		t.Errorf("tls_conf links to %s, err = %v, want tls_conf_1", link, err)
+	}
+	bs, err := ioutil.ReadFile(filepath.Join(confDir+"_0", "a.data"))
+	if err != nil || string(bs) != "0" {
+		t.Errorf("tls_conf_0/a.data = %s, err = %v, want 0", bs, err)
+	}
+	if versions, _ := fileStore.Versions(); !reflect.DeepEqual(versions, []string{"1", "0"}) {
+		t.Errorf("Versions() = %v, want [1 0]", versions)
+	}
+}
+
+func TestFileStore_Prune(t *testing.T) {
+	// version directories, true means modified long ago, tls_conf links to tls_conf_2
+	versions := map[string]bool{"0": true, "1": true, "2": true, "3": false, "10": false}
+
+	tests := []struct {
+		name      string
+		retention RetentionPolicy
+		want      []string
+	}{
+		{
+			name: "case_keep_current_only",
+			want: []string{"2"},
+		},
+		{
+			name:      "case_keep_count",
+			retention: RetentionPolicy{Count: 2},
+			want:      []string{"10", "2", "3"},
+		},
+		{
+			name:      "case_keep_age",
+			retention: RetentionPolicy{MaxAge: time.Hour},
+			want:      []string{"10", "2", "3"},
+		},
+		{
+			name:      "case_keep_count_and_age",
+			retention: RetentionPolicy{Count: 4, MaxAge: time.Hour},
+			want:      []string{"1", "10", "2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			confDir := filepath.Join(root, "tls_conf")
+			for version, old := range versions {
+				if err := xfile.FileOverwrite(confDir+"_"+version+"/a.data", []byte(version)); err != nil {
+					t.Fatal(err)
+				}
+				if old {
+					modTime := time.Now().Add(-2 * time.Hour)
+					if err := os.Chtimes(confDir+"_"+version, modTime, modTime); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := os.Symlink(confDir+"_2", confDir); err != nil {
+				t.Fatal(err)
+			}
+			// not a version directory
+			if err := xfile.FileOverwrite(filepath.Join(root, "tls_conf_bak/a.data"), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			fileStore, _ := NewFileStore(confDir, nil, tt.retention)
+			if err := fileStore.Prune(context.TODO()); err != nil {
+				t.Fatalf("Prune() error = %v", err)
+			}
+
+			dirs, _ := fileStore.versionDirs()
+			got := []string{}
+			for _, dir := range dirs {
+				got = append(got, dir.version)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Prune() left %v, want %v", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(root, "tls_conf_bak")); err != nil {
+				t.Errorf("tls_conf_bak should not be removed, err = %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStore_StoreFile2TmpDir(t *testing.T) {
+	root := t.TempDir()
+	staged := filepath.Join(root, "tls_conf.extra_files", "a.crt")
+	if err := xfile.FileOverwrite(staged, []byte("crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	fileStore, _ := NewFileStore(filepath.Join(root, "tls_conf"), nil, RetentionPolicy{})
+	err := fileStore.StoreFile2TmpDir(context.Background(), "1", map[string]*ConfFile{
+		"server_cert_conf.data": {Content: []byte("conf")},
+		"certs/a.crt":           {Path: staged},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"server_cert_conf.data": "conf", "certs/a.crt": "crt"} {
+		got, err := ioutil.ReadFile(filepath.Join(root, "tls_conf_1", name))
+		if err != nil || string(got) != want {
+			t.Errorf("content of %s = %s, err: %v", name, got, err)
+		}
+	}
+}
+
+func TestFileStore_Versions(t *testing.T) {
+	confDir := filepath.Join(t.TempDir(), "tls_conf")
+	for _, version := range []string{"0", "9", "10", "2"} {
+		if err := xfile.FileOverwrite(confDir+"_"+version+"/a.data", []byte(version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not version directories
+	if err := xfile.FileOverwrite(confDir+"_bak/a.data", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := xfile.FileOverwrite(confDir+"_3", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fileStore, _ := NewFileStore(confDir, nil, RetentionPolicy{})
+	versions, err := fileStore.Versions()
+	if err != nil {
+		t.Fatalf("Versions() error = %v", err)
+	}
+	if want := []string{"10", "9", "2", "0"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("Versions() = %v, want %v", versions, want)
+	}
+
+	for version, want := range map[string]bool{"9": true, "10": true, "3": false, "bak": false, "": false, "../tls_conf_9": false} {
+		if got := fileStore.HasVersion(version); got != want {
+			t.Errorf("HasVersion(%q) = %v, want %v", version, got, want)
+		}
+	}
+}
+
+func TestFileStore_Pin(t *testing.T) {
+	confDir := filepath.Join(t.TempDir(), "tls_conf")
+	fileStore, _ := NewFileStore(confDir, nil, RetentionPolicy{})
+
+	if pinned, err := fileStore.PinnedVersion(); err != nil || pinned != "" {
+		t.Fatalf("PinnedVersion() = %q, %v, want not pinned", pinned, err)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		if err := fileStore.Pin(version); err != nil {
+			t.Fatalf("Pin() error = %v", err)
+		}
+		if pinned, err := fileStore.PinnedVersion(); err != nil || pinned != version {
+			t.Errorf("PinnedVersion() = %q, %v, want %s", pinned, err, version)
+		}
+	}
+
+	// marker file edited by hand
+	if err := ioutil.WriteFile(confDir+".pin", []byte("3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pinned, _ := fileStore.PinnedVersion(); pinned != "3" {
+		t.Errorf("PinnedVersion() = %q, want 3", pinned)
+	}
+
+	// unpin twice is ok
+	for i := 0; i < 2; i++ {
+		if err := fileStore.Unpin(); err != nil {
+			t.Fatalf("Unpin() error = %v", err)
+		}
+	}
+	if pinned, err := fileStore.PinnedVersion(); err != nil || pinned != "" {
+		t.Errorf("PinnedVersion() = %q, %v, want not pinned", pinned, err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xfile"
+)
+
+// freezer decides whether a reloader is frozen.
+// A frozen reloader still probes, but doesn't apply updates.
+type freezer struct {
+	windows []config.FreezeWindow
+	// files are marker files, the last one belongs to the reloader itself
+	files []string
+}
+
+// frozenReason returns why reloader is frozen at now, returns "" if not frozen
+func (f *freezer) frozenReason(now time.Time) string {
+	for _, window := range f.windows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return fmt.Sprintf("freeze window [%s, %s)", window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
+		}
+	}
+
+	for _, file := range f.files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		reason := fmt.Sprintf("freeze file %s", file)
+		if content := strings.TrimSpace(string(bs)); content != "" {
+			reason += ": " + content
+		}
+		return reason
+	}
+
+	return ""
+}
+
+// reloaderFile returns the marker file of reloader itself
+func (f *freezer) reloaderFile() string {
+	return f.files[len(f.files)-1]
+}
+
+// FreezeByFile creates marker file with reason as content
+func FreezeByFile(file, reason string) error {
+	return xfile.FileOverwrite(file, []byte(reason))
+}
+
+// UnfreezeByFile removes marker file
+func UnfreezeByFile(file string) error {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
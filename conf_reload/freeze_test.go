@@ -0,0 +1,77 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+func Test_freezer_frozenReason(t *testing.T) {
+	start := time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+
+	tests := []struct {
+		name string
+
+		now        time.Time
+		freezeFile bool
+
+		wantFrozen bool
+	}{
+		{
+			name:       "case_before_window",
+			now:        start.Add(-time.Second),
+			wantFrozen: false,
+		},
+		{
+			name:       "case_window_start",
+			now:        start,
+			wantFrozen: true,
+		},
+		{
+			name:       "case_window_end",
+			now:        end,
+			wantFrozen: false,
+		},
+		{
+			name:       "case_freeze_file",
+			now:        end,
+			freezeFile: true,
+			wantFrozen: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := &freezer{
+				windows: []config.FreezeWindow{{Start: start, End: end}},
+				files:   []string{filepath.Join(dir, "conf-agent.freeze"), filepath.Join(dir, "tls_conf.freeze")},
+			}
+			if tt.freezeFile {
+				if err := FreezeByFile(f.reloaderFile(), "release"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := f.frozenReason(tt.now); (got != "") != tt.wantFrozen {
+				t.Errorf("frozenReason() = %q, wantFrozen %v", got, tt.wantFrozen)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/baidu/conf-agent/metrics"
+)
+
+// phases of a reload cycle
+const (
+	phaseProbe                = "Prober.Probe"
+	phaseStoreFile2TmpDir     = "StoreFile2TmpDir"
+	phaseTriggerBFEReload     = "TriggerBFEReload"
+	phaseUpdateDefaultConfDir = "UpdateDefaultConfDir"
+)
+
+var (
+	phaseTotal = metrics.NewCounterVec("conf_agent_phase_total",
+		"count of reload phases by result", "reloader", "phase", "result")
+	phaseDuration = metrics.NewHistogramVec("conf_agent_phase_duration_seconds",
+		"cost of reload phases in seconds", metrics.DefBuckets, "reloader", "phase")
+
+	cycleTotal = metrics.NewCounterVec("conf_agent_cycle_total",
+		"count of reload cycles by outcome", "reloader", "outcome")
+	lastSuccTime = metrics.NewGaugeVec("conf_agent_last_success_timestamp_seconds",
+		"finish time of last reload cycle which does not fail", "reloader")
+
+	appliedVersion = metrics.NewGaugeVec("conf_agent_applied_version",
+		"version ConfDir currently links to", "reloader")
+)
+
+func (r *Reloader) observePhase(phase string, begin time.Time, err error) {
+	result := "succ"
+	if err != nil {
+		result = "fail"
+	}
+
+	phaseTotal.Inc(r.Name, phase, result)
+	phaseDuration.Observe(time.Since(begin).Seconds(), r.Name, phase)
+}
+
+func (r *Reloader) observeCycle(outcome Outcome) {
+	cycleTotal.Inc(r.Name, string(outcome))
+	if !outcome.Failed() {
+		lastSuccTime.Set(float64(time.Now().Unix()), r.Name)
+	}
+}
+
+// updateAppliedVersion sets applied version gauge according to ConfDir
+func (r *Reloader) updateAppliedVersion() {
+	version, err := r.fileStore.CurrentVersion()
+	if err != nil || version == "" {
+		return
+	}
+
+	if v, ok := exactVersion(version); ok {
+		appliedVersion.Set(v, r.Name)
+	}
+}
+
+// exactVersion parses version as a gauge value, it fails if version is not a number
+// or loses precision in float64, such as timestamps in ns
+func exactVersion(version string) (float64, bool) {
+	v, err := strconv.ParseFloat(version, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return v, strconv.FormatFloat(v, 'f', -1, 64) == version
+}
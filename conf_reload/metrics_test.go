@@ -0,0 +1,38 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import "testing"
+
+func Test_exactVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    float64
+		wantOK  bool
+	}{
+		{version: "20211207", want: 20211207, wantOK: true},
+		{version: "20211207123456", want: 20211207123456, wantOK: true},
+		// timestamp in ns doesn't fit in float64
+		{version: "1639000000000123456", wantOK: false},
+		{version: "0012", wantOK: false},
+		{version: "v1.2", wantOK: false},
+	}
+	for _, tt := range tests {
+		got, ok := exactVersion(tt.version)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("exactVersion(%s) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+// BreakerState is the state of circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets all calls through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen short-circuits calls until cooldown elapsed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a probe call through, its result closes or opens breaker again
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+var breakerOpen = metrics.NewGaugeVec("conf_agent_circuit_breaker_open",
+	"1 if circuit breaker of conf api is open or half open, 0 if closed", "reloader", "conf_api")
+
+// BreakerStatus is the status of circuit breaker of a conf api
+type BreakerStatus struct {
+	ConfAPI             string
+	State               BreakerState
+	ConsecutiveFailures int
+	// OpenedAt is the time breaker opened last time
+	OpenedAt time.Time
+}
+
+// circuitBreaker opens after consecutive failures of a conf api, it's safe for concurrent use
+type circuitBreaker struct {
+	confAPI string
+	config  config.BreakerConfig
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is true if the probe call of half open state is running
+	probing bool
+}
+
+func newCircuitBreaker(confAPI string, c config.BreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		confAPI: confAPI,
+		config:  c,
+		state:   BreakerClosed,
+	}
+}
+
+// allow returns error if the call is short-circuited
+func (b *circuitBreaker) allow(ctx context.Context) error {
+	if b.config.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.config.Cooldown - time.Since(b.openedAt); wait > 0 {
+			return fmt.Errorf("circuit breaker of %s is open, retry after %s", b.confAPI, wait.Round(time.Millisecond))
+		}
+		b.setState(ctx, BreakerHalfOpen)
+		b.probing = true
+		return nil
+
+	case BreakerHalfOpen:
+		if b.probing {
+			return fmt.Errorf("circuit breaker of %s is half open, probe is running", b.confAPI)
+		}
+		b.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+// allowWatch returns error unless breaker is closed.
+// Watch requests may be held by conf server for long, so they never take the probe call of half open state,
+// and their results are not recorded, breaker is driven by regular requests only.
+func (b *circuitBreaker) allowWatch() error {
+	if b.config.FailureThreshold <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state != BreakerClosed {
+		return fmt.Errorf("circuit breaker of %s is %s", b.confAPI, b.state)
+	}
+
+	return nil
+}
+
+// record records result of an allowed call
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if b.config.FailureThreshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+
+	// canceled by caller, such as another task of the cycle failed
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	if err == nil {
+		b.failures = 0
+		b.setState(ctx, BreakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.openedAt = time.Now()
+		b.setState(ctx, BreakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(ctx context.Context, state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "CircuitBreaker", b.confAPI, " ", b.state, " -> ", state,
+		", consecutive failures: ", b.failures))
+	b.state = state
+
+	open := 0.0
+	if state != BreakerClosed {
+		open = 1
+	}
+	breakerOpen.Set(open, xlog.ReloaderName(ctx), b.confAPI)
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return BreakerStatus{
+		ConfAPI:             b.confAPI,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		OpenedAt:            b.openedAt,
+	}
+}
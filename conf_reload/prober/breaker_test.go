@@ -0,0 +1,82 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	b := newCircuitBreaker("/conf", config.BreakerConfig{
+		FailureThreshold: 2,
+		Cooldown:         50 * time.Millisecond,
+	})
+	fail := fmt.Errorf("fail")
+
+	// opens after consecutive failures
+	for i := 0; i < 2; i++ {
+		if err := b.allow(ctx); err != nil {
+			t.Fatalf("allow() = %v, want nil when closed", err)
+		}
+		b.record(ctx, fail)
+	}
+	if state := b.status().State; state != BreakerOpen {
+		t.Fatalf("got state %s, want open", state)
+	}
+	if err := b.allow(ctx); err == nil {
+		t.Fatalf("allow() = nil, want error when open")
+	}
+
+	// a probe is let through after cooldown, failure opens again
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(ctx); err != nil {
+		t.Fatalf("allow() = %v, want probe after cooldown", err)
+	}
+	if err := b.allow(ctx); err == nil {
+		t.Fatalf("allow() = nil, want only one probe when half open")
+	}
+	b.record(ctx, fail)
+	if state := b.status().State; state != BreakerOpen {
+		t.Fatalf("got state %s, want open", state)
+	}
+
+	// succ probe closes breaker
+	time.Sleep(60 * time.Millisecond)
+	if err := b.allow(ctx); err != nil {
+		t.Fatalf("allow() = %v, want probe after cooldown", err)
+	}
+	b.record(ctx, nil)
+	status := b.status()
+	if status.State != BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("got status %+v, want closed", status)
+	}
+
+	// canceled calls are not failures
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		b.allow(canceled)
+		b.record(canceled, context.Canceled)
+	}
+	if state := b.status().State; state != BreakerClosed {
+		t.Errorf("got state %s, want closed", state)
+	}
+}
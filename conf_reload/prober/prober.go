@@ -16,50 +16,210 @@ package prober
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xhttp"
+	"github.com/baidu/conf-agent/xlog"
 )
 
+var taskDownloadBytes = metrics.NewCounterVec("conf_agent_task_download_bytes_total",
+	"bytes downloaded by task, including extra files", "reloader", "task")
+
+func recordDownloadBytes(ctx context.Context, task string, n int64) {
+	taskDownloadBytes.Add(float64(n), xlog.ReloaderName(ctx), task)
+}
+
+type dryRunKey struct{}
+
+// WithDryRun marks ctx as a dry run, tasks fetch files without writing anything to disk then
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
 type FetchFileResult struct {
 	Name    string
 	Version string
 	Content []byte
+	// Path is the local file holding content if it's streamed to disk, Content is nil then
+	Path string
 }
 
 type commonConfig struct {
+	// TaskName is the name of task, used in metrics
+	TaskName string
+
 	BFECluster string
 
 	ConfTaskHeaders map[string]string
 	ConfTaskTimeout time.Duration
+	// ConfTaskWatchTimeout is the max time conf server holds a watch request
+	ConfTaskWatchTimeout time.Duration
+
+	// ConfAPIMethod is GET or POST, POST body carries versions of ReloaderFiles in ConfDir
+	ConfAPIMethod string
+	ConfDir       string
+	ReloaderFiles []string
+
+	// MaxConfResponseBytes is the max size of conf API response, 0 means no limit
+	MaxConfResponseBytes int64
+
+	// ConfServer selects endpoint of conf server for requests
+	ConfServer *xhttp.EndpointPool
+	// Transport sends requests with TLS options of task, it's shared by tasks with the same options
+	Transport *xhttp.Transport
+
+	HTTPRetry config.RetryConfig
+	// Breaker short-circuits requests to ConfAPI after consecutive failures
+	Breaker *circuitBreaker
+
+	// Validators remembers ETag/Last-Modified of conf API responses without newer config
+	Validators *xhttp.ValidatorCache
+}
+
+func newEndpointPool(c config.EndpointConfig) *xhttp.EndpointPool {
+	return xhttp.NewEndpointPool(c.Endpoints, c.Strategy, c.Cooldown)
 }
 
 type Task interface {
+	// Name returns the name of task
+	Name() string
 	FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error)
 }
 
+// Watcher is a task which can watch(long-poll) conf server for newer config
+type Watcher interface {
+	Name() string
+	// WatchTimeout is the max time conf server holds a watch request, 0 means watch is disabled
+	WatchTimeout() time.Duration
+	// Watch blocks until conf server has newer config than local or WatchTimeout,
+	// returns true if newer config exists
+	Watch(ctx context.Context) (bool, error)
+}
+
 type Prober struct {
+	config config.ProbeConfig
+
 	tasks []Task
 }
 
+// runBounded calls run for each i in [0, n) concurrently, at most concurrency calls at the same time.
+// The first error cancels other calls, so only it is reported.
+// ctx.Err() is reported if ctx is done before a call starts.
+func runBounded(ctx context.Context, n, concurrency int, run func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+
+			if err := run(ctx, i); err != nil {
+				fail(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// Probe runs all tasks concurrently, at most config.Concurrency tasks at the same time.
+// It fails if any task fails, other running tasks are canceled then.
 func (prober *Prober) Probe(ctx context.Context) ([]*FetchFileResult, error) {
-	result := []*FetchFileResult{}
+	if prober.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, prober.config.Timeout)
+		defer cancel()
+	}
 
-	for _, p := range prober.tasks {
-		fileList, err := p.FetchConfFiles(ctx)
+	fileLists := make([][]*FetchFileResult, len(prober.tasks))
+	err := runBounded(ctx, len(prober.tasks), prober.config.Concurrency, func(ctx context.Context, i int) error {
+		task := prober.tasks[i]
+		fileList, err := task.FetchConfFiles(ctx)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("task %s fail, err: %v", task.Name(), err)
 		}
+		fileLists[i] = fileList
+		return nil
+	})
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("tasks not run, err: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		result = append(fileList, result...)
+	// keep the order of sequential probe: files of later task come first
+	result := []*FetchFileResult{}
+	for i := len(fileLists) - 1; i >= 0; i-- {
+		result = append(result, fileLists[i]...)
 	}
 
 	return result, nil
 }
 
-func NewProber(nfts []*config.NormalFileTaskConfig, mfts []*config.MultiJSONKeyFileTaskConfig,
+// BreakerStatus returns status of circuit breakers of all tasks
+func (prober *Prober) BreakerStatus() []BreakerStatus {
+	status := []BreakerStatus{}
+	for _, task := range prober.tasks {
+		if t, ok := task.(interface{ BreakerStatus() BreakerStatus }); ok {
+			status = append(status, t.BreakerStatus())
+		}
+	}
+
+	return status
+}
+
+// Watchers returns tasks which enable watch
+func (prober *Prober) Watchers() []Watcher {
+	watchers := []Watcher{}
+	for _, task := range prober.tasks {
+		if watcher, ok := task.(Watcher); ok && watcher.WatchTimeout() > 0 {
+			watchers = append(watchers, watcher)
+		}
+	}
+
+	return watchers
+}
+
+func NewProber(c config.ProbeConfig, nfts []*config.NormalFileTaskConfig, mfts []*config.MultiJSONKeyFileTaskConfig,
 	efts []*config.ExtraFileTaskConfig) (*Prober, error) {
-	prober := &Prober{}
+	prober := &Prober{
+		config: c,
+	}
 
 	for _, t := range nfts {
 		p, err := NewNormalFileTask(*t)
@@ -0,0 +1,185 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+type fakeTask struct {
+	name string
+	cost time.Duration
+	fail bool
+
+	running, maxRunning *int32
+}
+
+func (task *fakeTask) Name() string {
+	return task.name
+}
+
+func (task *fakeTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error) {
+	running := atomic.AddInt32(task.running, 1)
+	defer atomic.AddInt32(task.running, -1)
+	for {
+		max := atomic.LoadInt32(task.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(task.maxRunning, max, running) {
+			break
+		}
+	}
+
+	select {
+	case <-time.After(task.cost):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if task.fail {
+		return nil, fmt.Errorf("fail")
+	}
+	return []*FetchFileResult{{Name: task.name}}, nil
+}
+
+func TestProber_Probe(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.ProbeConfig
+		costs  []time.Duration
+		fails  []bool
+
+		wantNames      string
+		wantErr        bool
+		wantMaxRunning int32
+	}{
+		{
+			name:           "case_sequential",
+			config:         config.ProbeConfig{Concurrency: 1},
+			costs:          []time.Duration{time.Millisecond, 0, 0},
+			fails:          []bool{false, false, false},
+			wantNames:      "t2,t1,t0,",
+			wantMaxRunning: 1,
+		},
+		{
+			name:           "case_concurrent",
+			config:         config.ProbeConfig{Concurrency: 2},
+			costs:          []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 0},
+			fails:          []bool{false, false, false},
+			wantNames:      "t2,t1,t0,",
+			wantMaxRunning: 2,
+		},
+		{
+			name:    "case_fail",
+			config:  config.ProbeConfig{Concurrency: 3},
+			costs:   []time.Duration{time.Second, 0, time.Second},
+			fails:   []bool{false, true, false},
+			wantErr: true,
+		},
+		{
+			name:    "case_timeout",
+			config:  config.ProbeConfig{Concurrency: 3, Timeout: 10 * time.Millisecond},
+			costs:   []time.Duration{time.Second, 0, 0},
+			fails:   []bool{false, false, false},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running, maxRunning int32
+			prober := &Prober{config: tt.config}
+			for i := range tt.costs {
+				prober.tasks = append(prober.tasks, &fakeTask{
+					name:       fmt.Sprintf("t%d", i),
+					cost:       tt.costs[i],
+					fail:       tt.fails[i],
+					running:    &running,
+					maxRunning: &maxRunning,
+				})
+			}
+
+			begin := time.Now()
+			fileList, err := prober.Probe(context.TODO())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if cost := time.Since(begin); cost > 500*time.Millisecond {
+					t.Errorf("Probe() should cancel other tasks, cost %s", cost)
+				}
+				return
+			}
+
+			names := ""
+			for _, file := range fileList {
+				names += file.Name + ","
+			}
+			if names != tt.wantNames {
+				t.Errorf("Probe() names = %s, want %s", names, tt.wantNames)
+			}
+			if maxRunning != tt.wantMaxRunning {
+				t.Errorf("Probe() max running = %d, want %d", maxRunning, tt.wantMaxRunning)
+			}
+		})
+	}
+}
+
+func Test_runBounded(t *testing.T) {
+	var running, maxRunning int32
+	err := runBounded(context.Background(), 8, 3, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning > 3 {
+		t.Errorf("max running %d, want at most 3", maxRunning)
+	}
+
+	// the first error cancels other calls, only it is reported
+	begin := time.Now()
+	err = runBounded(context.Background(), 4, 4, func(ctx context.Context, i int) error {
+		if i == 0 {
+			return fmt.Errorf("call 0 fail")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	if err == nil || err.Error() != "call 0 fail" {
+		t.Errorf("runBounded() error = %v, want call 0 fail", err)
+	}
+	if cost := time.Since(begin); cost > time.Second {
+		t.Errorf("runBounded() cost %s, other calls are not canceled", cost)
+	}
+}
@@ -17,8 +17,15 @@ package prober
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/baidu/conf-agent/config"
 	"github.com/baidu/conf-agent/xhttp"
@@ -30,6 +37,64 @@ type ExtraFileTask struct {
 	config config.ExtraFileTaskConfig
 
 	normalFileTask *NormalFileTask
+
+	// extraFileServer selects endpoint of extra file server for downloads
+	extraFileServer *xhttp.EndpointPool
+
+	// cache keeps extra files referenced by last fetched conf file
+	cache *extraFileCache
+
+	// downloadDir stages extra files streamed to disk, it's {ConfDir}.extra_files/{ConfFileName}
+	downloadDir string
+	// staged is the files in downloadDir written by this task, other files there are never removed
+	stagedLock sync.Mutex
+	staged     map[string]bool
+}
+
+// extraFile is an extra file referenced by conf file
+type extraFile struct {
+	// Name is the file name in conf file, look like {module}_{version}/xxxx
+	Name string
+	// RemotePath look like {module}/xxxx
+	RemotePath string
+	// LocalPath look like xxxx
+	LocalPath string
+}
+
+type cachedExtraFile struct {
+	name    string
+	content []byte
+	// path is the local file holding content if it's streamed to disk, content is nil then
+	path string
+
+	// validator is zero if content is not downloaded
+	validator xhttp.Validator
+}
+
+// extraFileCache keeps content of extra files, keyed by remote path.
+// Content of {module}_{version}/xxxx never changes, so an entry is reused only if name matches.
+type extraFileCache struct {
+	lock  sync.Mutex
+	files map[string]*cachedExtraFile
+}
+
+// get returns cached file of remote path, it may have another name
+func (cache *extraFileCache) get(file *extraFile) *cachedExtraFile {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.files[file.RemotePath]
+}
+
+// reset replaces all entries, extra files not referenced any more are dropped
+func (cache *extraFileCache) reset(files []*extraFile, cachedFiles []*cachedExtraFile) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.files = map[string]*cachedExtraFile{}
+	for i, file := range files {
+		cache.files[file.RemotePath] = cachedFiles[i]
+	}
 }
 
 func NewExtraFileTask(c config.ExtraFileTaskConfig) (*ExtraFileTask, error) {
@@ -42,9 +107,35 @@ func NewExtraFileTask(c config.ExtraFileTaskConfig) (*ExtraFileTask, error) {
 		config: c,
 
 		normalFileTask: np,
+
+		extraFileServer: newEndpointPool(c.ExtraFileServer),
+
+		cache: &extraFileCache{
+			files: map[string]*cachedExtraFile{},
+		},
+
+		downloadDir: filepath.Join(c.ConfDir+".extra_files", c.ConfFileName),
+		staged:      map[string]bool{},
 	}, nil
 }
 
+func (task *ExtraFileTask) Name() string {
+	return task.normalFileTask.Name()
+}
+
+func (task *ExtraFileTask) BreakerStatus() BreakerStatus {
+	return task.normalFileTask.BreakerStatus()
+}
+
+func (task *ExtraFileTask) WatchTimeout() time.Duration {
+	return task.normalFileTask.WatchTimeout()
+}
+
+// Watch watches conf file only, extra files change with it
+func (task *ExtraFileTask) Watch(ctx context.Context) (bool, error) {
+	return task.normalFileTask.Watch(ctx)
+}
+
 func (task *ExtraFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error) {
 	fileList, err := task.normalFileTask.FetchConfFiles(ctx)
 	if err != nil {
@@ -61,21 +152,105 @@ func (task *ExtraFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResu
 		return nil, err
 	}
 
-	for remotePath, localPath := range extraFiles {
-		fileContent, err := task.obtainExtraFile(ctx, remotePath)
-		if err != nil {
-			return nil, err
-		}
+	cachedFiles, err := task.obtainExtraFilesContent(ctx, extraFiles)
+	if err != nil {
+		return nil, err
+	}
+	// files of dry run are not used later
+	if !isDryRun(ctx) {
+		task.cache.reset(extraFiles, cachedFiles)
+		task.cleanDownloadDir(ctx, cachedFiles)
+	}
 
+	for i, file := range extraFiles {
 		fileList = append(fileList, &FetchFileResult{
-			Name:    localPath,
-			Content: fileContent,
+			Name:    file.LocalPath,
+			Content: cachedFiles[i].content,
+			Path:    cachedFiles[i].path,
 		})
 	}
 
 	return fileList, err
 }
 
+// obtainExtraFilesContent obtains content of extra files by a bounded worker pool.
+// Content is reused from cache or current conf dir if possible, otherwise downloaded.
+func (task *ExtraFileTask) obtainExtraFilesContent(ctx context.Context, extraFiles []*extraFile) ([]*cachedExtraFile, error) {
+	localFiles := task.localExtraFiles(ctx)
+
+	cachedFiles := make([]*cachedExtraFile, len(extraFiles))
+	// downloads is the index of files to download
+	downloads := []int{}
+	for i, file := range extraFiles {
+		cached := task.cache.get(file)
+		if cached != nil && cached.name == file.Name {
+			cachedFiles[i] = cached
+			continue
+		}
+
+		if localFiles[file.Name] {
+			localPath := filepath.Join(task.config.ConfDir, file.LocalPath)
+			if task.config.ExtraFileStreamToDisk {
+				if _, err := os.Stat(localPath); err == nil {
+					cachedFiles[i] = &cachedExtraFile{
+						name: file.Name,
+						path: localPath,
+					}
+					continue
+				}
+			}
+
+			content, err := ioutil.ReadFile(localPath)
+			if err == nil {
+				cachedFiles[i] = &cachedExtraFile{
+					name:    file.Name,
+					content: content,
+				}
+				continue
+			}
+			xlog.Default.Info(xlog.ErrLogFormat(ctx, "TaskExtraFile.reuse", err))
+		}
+
+		downloads = append(downloads, i)
+	}
+
+	err := runBounded(ctx, len(downloads), task.config.ExtraFileTaskConcurrency, func(ctx context.Context, j int) error {
+		i := downloads[j]
+		downloaded, err := task.obtainExtraFile(ctx, extraFiles[i], task.cache.get(extraFiles[i]))
+		if err != nil {
+			return err
+		}
+		cachedFiles[i] = downloaded
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cachedFiles, nil
+}
+
+// localExtraFiles returns names of extra files referenced by conf file in current conf dir
+func (task *ExtraFileTask) localExtraFiles(ctx context.Context) map[string]bool {
+	names := map[string]bool{}
+
+	bs, err := ioutil.ReadFile(filepath.Join(task.config.ConfDir, task.config.ConfFileName))
+	if err != nil {
+		return names
+	}
+
+	files, err := task.obtainExtraFiles(ctx, bs)
+	if err != nil {
+		return names
+	}
+
+	for _, file := range files {
+		names[file.Name] = true
+	}
+
+	return names
+}
+
 // convert {module}_{version}/xxxx to {module}/xxxx and xxxx
 func removeDirVersionInfo(fileName string) (remotePath, localPath string, err error) {
 	slashIndex := strings.Index(fileName, "/")
@@ -96,7 +271,8 @@ func removeDirVersionInfo(fileName string) (remotePath, localPath string, err er
 	return moduleWithVersion[:underlineIndex] + fileName[slashIndex:], fileName[slashIndex+1:], nil
 }
 
-func (prober *ExtraFileTask) obtainExtraFiles(ctx context.Context, fileContent []byte) (map[string]string, error) {
+// obtainExtraFiles parses conf file, returns extra files sorted by remote path
+func (prober *ExtraFileTask) obtainExtraFiles(ctx context.Context, fileContent []byte) ([]*extraFile, error) {
 	jsonData, err := oj.Parse(fileContent)
 	if err != nil {
 		err = fmt.Errorf("parse fail, content: %s, err: %v", string(fileContent), err)
@@ -105,7 +281,7 @@ func (prober *ExtraFileTask) obtainExtraFiles(ctx context.Context, fileContent [
 		return nil, err
 	}
 
-	remotePath2localPath := map[string]string{}
+	remotePath2File := map[string]*extraFile{}
 	for _, pattern := range prober.config.JSONPaths {
 		results := pattern.Get(jsonData)
 
@@ -116,33 +292,150 @@ func (prober *ExtraFileTask) obtainExtraFiles(ctx context.Context, fileContent [
 				return nil, err
 			}
 
-			remotePath2localPath[remote] = local
+			remotePath2File[remote] = &extraFile{
+				Name:       fileName,
+				RemotePath: remote,
+				LocalPath:  local,
+			}
 		}
 	}
 
-	return remotePath2localPath, nil
+	files := []*extraFile{}
+	for _, file := range remotePath2File {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].RemotePath < files[j].RemotePath
+	})
+
+	return files, nil
 }
 
-func (prober *ExtraFileTask) obtainExtraFile(ctx context.Context, fileName string) (raw []byte, err error) {
+// obtainExtraFile downloads extra file. If cached is downloaded before, a conditional request is sent,
+// and cached content is reused when server replies 304.
+func (prober *ExtraFileTask) obtainExtraFile(ctx context.Context, file *extraFile, cached *cachedExtraFile) (*cachedExtraFile, error) {
 	config := prober.config
 
+	validator := xhttp.Validator{}
+	if cached != nil {
+		validator = cached.validator
+	}
+
 	req := xhttp.NewHTTPRequest().
 		Decorate(
-			xhttp.SimpleRequestOp(http.MethodGet, config.ExtraFileServer+fileName, nil),
+			xhttp.HTTPRequestContextOp(ctx),
+			xhttp.SimpleRequestOp(http.MethodGet, file.RemotePath, nil),
+			xhttp.HTTPRequestEndpointOp(prober.extraFileServer),
+			xhttp.HTTPRequestTransportOp(prober.normalFileTask.commonConfig.Transport),
 			xhttp.HTTPRequestTimeoutOp(config.ExtraFileTaskTimeout),
-			xhttp.HTTPRequestHeaderOp(config.ExtraFileTaskHeaders)).
-		Do().
-		Decorate(
+			xhttp.HTTPRequestMaxBodySizeOp(config.MaxExtraFileBytes),
+			xhttp.HTTPRequestRetryOp(config.HTTPRetry.Attempts, config.HTTPRetry.Backoff),
+			xhttp.HTTPRequestHeaderOp(config.ExtraFileTaskHeaders),
+			xhttp.ConditionalRequestOp(validator)).
+		Do()
+	defer req.Close()
+
+	// status is checked before body is streamed to disk, so error page is not stored.
+	// Dry run keeps body in memory, so files staged by a running agent are not touched.
+	path := ""
+	if config.ExtraFileStreamToDisk && !isDryRun(ctx) {
+		req.Decorate(xhttp.RspCode200Or304Op)
+		if req.Err() == nil && !req.NotModified() {
+			path = filepath.Join(prober.downloadDir, url.PathEscape(file.Name))
+			if err := prober.streamToFile(path, req); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		req.Decorate(
 			xhttp.RspBodyRawReaderOp,
-			xhttp.RspCode200Op,
+			xhttp.RspCode200Or304Op,
 		)
+	}
 
-	err = req.Err()
+	recordDownloadBytes(ctx, prober.Name(), req.BodySize())
+
+	if err := req.Err(); err != nil {
+		return nil, err
+	}
+
+	if req.NotModified() {
+		if validator.IsZero() {
+			return nil, fmt.Errorf("url: %s, err: unexpected StatuCode 304", req.Request.URL.String())
+		}
+
+		return &cachedExtraFile{
+			name:      file.Name,
+			content:   cached.content,
+			path:      cached.path,
+			validator: validator,
+		}, nil
+	}
+
+	return &cachedExtraFile{
+		name:      file.Name,
+		content:   req.RawContent,
+		path:      path,
+		validator: req.Validator(),
+	}, nil
+}
+
+// streamToFile writes body of req to path. Body is written to a temporary file which is renamed
+// to path when completed, so path is either absent or complete.
+func (prober *ExtraFileTask) streamToFile(path string, req *xhttp.HTTPRequest) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".download"
+	f, err := os.Create(tmpPath)
 	if err != nil {
-		return
+		return err
 	}
 
-	raw = req.RawContent
+	if err := req.Decorate(xhttp.RspBodyWriterOp(f)).Err(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
 
-	return
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	prober.stagedLock.Lock()
+	prober.staged[path] = true
+	prober.stagedLock.Unlock()
+
+	return nil
+}
+
+// cleanDownloadDir removes files staged by this task but not referenced by cachedFiles.
+// Files linked to version directories are kept there.
+func (prober *ExtraFileTask) cleanDownloadDir(ctx context.Context, cachedFiles []*cachedExtraFile) {
+	referenced := map[string]bool{}
+	for _, cached := range cachedFiles {
+		referenced[cached.path] = true
+	}
+
+	prober.stagedLock.Lock()
+	defer prober.stagedLock.Unlock()
+
+	for path := range prober.staged {
+		if referenced[path] {
+			continue
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			xlog.Default.Error(xlog.ErrLogFormat(ctx, "TaskExtraFile.cleanDownloadDir", err))
+			continue
+		}
+		delete(prober.staged, path)
+	}
 }
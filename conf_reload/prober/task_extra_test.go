@@ -0,0 +1,294 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prober
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/ohler55/ojg/jp"
+)
+
+type extraFileServer struct {
+	lock      sync.Mutex
+	confData  string
+	downloads map[string]int
+	// notModified counts 304 responses of extra files
+	notModified map[string]int
+}
+
+func (s *extraFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r.URL.Path == "/conf" {
+		fmt.Fprintf(w, `{"ErrNum": 200, "Data": %s}`, s.confData)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "fail") {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + r.URL.Path + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified[r.URL.Path]++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.downloads[r.URL.Path]++
+	w.Header().Set("ETag", etag)
+	fmt.Fprintf(w, "content of %s", r.URL.Path)
+}
+
+func (s *extraFileServer) setConf(files ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.confData = fmt.Sprintf(`{"Version": "%d", "Files": ["%s"]}`, time.Now().UnixNano(), strings.Join(files, `", "`))
+}
+
+func (s *extraFileServer) downloadCount(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.downloads[path]
+}
+
+func (s *extraFileServer) notModifiedCount(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.notModified[path]
+}
+
+func newTestExtraFileTask(t *testing.T, server *httptest.Server, confDir string) *ExtraFileTask {
+	task, err := NewExtraFileTask(config.ExtraFileTaskConfig{
+		NormalFileTaskConfig: config.NormalFileTaskConfig{
+			ConfDir:         confDir,
+			ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+			ConfAPI:         "/conf",
+			ConfFileName:    "extra.data",
+			ConfTaskTimeout: time.Second,
+		},
+		ExtraFileServer:          config.EndpointConfig{Endpoints: []string{server.URL + "/"}},
+		ExtraFileTaskTimeout:     time.Second,
+		ExtraFileTaskConcurrency: 2,
+		JSONPaths:                []jp.Expr{jp.MustParseString("$.Files[*]")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return task
+}
+
+func TestExtraFileTaskFetchConfFiles(t *testing.T) {
+	s := &extraFileServer{downloads: map[string]int{}, notModified: map[string]int{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	confDir := t.TempDir()
+	task := newTestExtraFileTask(t, server, confDir)
+
+	s.setConf("a_1/a.txt", "b_1/b.txt", "c_1/c.txt")
+	files, err := task.FetchConfFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("got %d files, want 4", len(files))
+	}
+	for i, name := range []string{"extra.data", "a.txt", "b.txt", "c.txt"} {
+		if files[i].Name != name {
+			t.Errorf("files[%d] = %s, want %s", i, files[i].Name, name)
+		}
+	}
+	if got := string(files[2].Content); got != "content of /b/b.txt" {
+		t.Errorf("content of b.txt = %s", got)
+	}
+
+	// only the changed file is downloaded again
+	s.setConf("a_1/a.txt", "b_2/b.txt", "c_1/c.txt")
+	if _, err := task.FetchConfFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{"/a/a.txt": 1, "/b/b.txt": 1, "/c/c.txt": 1} {
+		if got := s.downloadCount(path); got != want {
+			t.Errorf("%s downloaded %d times, want %d", path, got, want)
+		}
+	}
+	// b.txt is renamed, content is validated by conditional request
+	if got := s.notModifiedCount("/b/b.txt"); got != 1 {
+		t.Errorf("b.txt not modified %d times, want 1", got)
+	}
+
+	// a failed download fails the task
+	s.setConf("a_1/a.txt", "d_1/fail")
+	if _, err := task.FetchConfFiles(context.Background()); err == nil {
+		t.Errorf("want error when extra file download fail")
+	}
+}
+
+func TestExtraFileTaskReuseLocalFile(t *testing.T) {
+	s := &extraFileServer{downloads: map[string]int{}, notModified: map[string]int{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// current conf dir already contains a_1/a.txt
+	confDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(confDir, "extra.data"), []byte(`{"Version": "1", "Files": ["a_1/a.txt"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(confDir, "a.txt"), []byte("local a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	task := newTestExtraFileTask(t, server, confDir)
+
+	s.setConf("a_1/a.txt", "b_1/b.txt")
+	files, err := task.FetchConfFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(files[1].Content); got != "local a" {
+		t.Errorf("content of a.txt = %s, want local a", got)
+	}
+	if got := s.downloadCount("/a/a.txt"); got != 0 {
+		t.Errorf("a.txt downloaded %d times, want 0", got)
+	}
+	if got := s.downloadCount("/b/b.txt"); got != 1 {
+		t.Errorf("b.txt downloaded %d times, want 1", got)
+	}
+}
+
+func TestExtraFileTaskStreamToDisk(t *testing.T) {
+	s := &extraFileServer{downloads: map[string]int{}, notModified: map[string]int{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	confDir := filepath.Join(t.TempDir(), "mod")
+	task := newTestExtraFileTask(t, server, confDir)
+	task.config.ExtraFileStreamToDisk = true
+	task.config.MaxExtraFileBytes = 64
+
+	s.setConf("a_1/a.txt", "b_1/b.txt")
+	files, err := task.FetchConfFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files[1:] {
+		if file.Content != nil || file.Path == "" {
+			t.Fatalf("%s is not streamed to disk", file.Name)
+		}
+		if dir := filepath.Dir(file.Path); dir != filepath.Join(confDir+".extra_files", "extra.data") {
+			t.Errorf("%s is staged in %s", file.Name, dir)
+		}
+	}
+	content, err := ioutil.ReadFile(files[2].Path)
+	if err != nil || string(content) != "content of /b/b.txt" {
+		t.Errorf("content of b.txt = %s, err: %v", content, err)
+	}
+
+	// renamed file is validated by conditional request, stale staged files are removed
+	s.setConf("a_1/a.txt", "b_2/b.txt")
+	files, err = task.FetchConfFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.notModifiedCount("/b/b.txt"); got != 1 {
+		t.Errorf("b.txt not modified %d times, want 1", got)
+	}
+	if content, err := ioutil.ReadFile(files[2].Path); err != nil || string(content) != "content of /b/b.txt" {
+		t.Errorf("content of b.txt = %s, err: %v", content, err)
+	}
+
+	s.setConf("a_1/a.txt")
+	if _, err := task.FetchConfFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	staged, _ := filepath.Glob(filepath.Join(confDir+".extra_files", "extra.data", "*"))
+	if len(staged) != 1 {
+		t.Errorf("staged files = %v, want a.txt only", staged)
+	}
+
+	// file larger than MaxExtraFileBytes fails the task
+	task.config.MaxExtraFileBytes = 8
+	s.setConf("c_1/c.txt")
+	if _, err := task.FetchConfFiles(context.Background()); err == nil {
+		t.Errorf("want error when extra file exceeds max size")
+	}
+}
+
+func TestExtraFileTaskStreamToDiskDryRun(t *testing.T) {
+	s := &extraFileServer{downloads: map[string]int{}, notModified: map[string]int{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	confDir := filepath.Join(t.TempDir(), "mod")
+	task := newTestExtraFileTask(t, server, confDir)
+	task.config.ExtraFileStreamToDisk = true
+
+	// a file being staged by another process
+	downloadDir := filepath.Join(confDir+".extra_files", "extra.data")
+	if err := os.MkdirAll(downloadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	foreign := filepath.Join(downloadDir, "x_1%2Fx.txt.download")
+	if err := ioutil.WriteFile(foreign, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// dry run keeps content in memory
+	s.setConf("a_1/a.txt", "b_1/b.txt")
+	files, err := task.FetchConfFiles(WithDryRun(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(files[2].Content); got != "content of /b/b.txt" || files[2].Path != "" {
+		t.Errorf("b.txt of dry run: content %q, path %q", got, files[2].Path)
+	}
+	staged, _ := filepath.Glob(filepath.Join(downloadDir, "*"))
+	if len(staged) != 1 || staged[0] != foreign {
+		t.Errorf("staged files after dry run = %v, want %s only", staged, foreign)
+	}
+
+	// files not staged by the task are kept when cleaning
+	if _, err := task.FetchConfFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.setConf("a_1/a.txt")
+	if _, err := task.FetchConfFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	staged, _ = filepath.Glob(filepath.Join(downloadDir, "*"))
+	if len(staged) != 2 {
+		t.Errorf("staged files = %v, want a.txt and %s", staged, foreign)
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("file staged by another process is removed, err: %v", err)
+	}
+}
@@ -18,8 +18,12 @@ import (
 	"context"
 	"encoding/json"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xhttp"
 	"github.com/baidu/conf-agent/xlog"
 )
 
@@ -30,24 +34,77 @@ type MultiKeyFileTask struct {
 }
 
 func NewMultiKeyFileTask(c config.MultiJSONKeyFileTaskConfig) (*MultiKeyFileTask, error) {
+	transport, err := xhttp.GetTransport(c.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MultiKeyFileTask{
 		config: c,
 		commonConfig: commonConfig{
+			TaskName:        multiKeyTaskName(c.Key2ConfFile),
 			BFECluster:      c.BFECluster,
 			ConfTaskHeaders: c.ConfTaskHeaders,
 			ConfTaskTimeout: c.ConfTaskTimeout,
+			Validators:      xhttp.NewValidatorCache(),
+
+			ConfTaskWatchTimeout: c.ConfTaskWatchTimeout,
+			ConfAPIMethod:        c.ConfAPIMethod,
+			ConfDir:              c.ConfDir,
+			ReloaderFiles:        c.ReloaderFiles,
+			MaxConfResponseBytes: c.MaxConfResponseBytes,
+			HTTPRetry:            c.HTTPRetry,
+			ConfServer:           newEndpointPool(c.ConfServer),
+			Transport:            transport,
+			Breaker:              newCircuitBreaker(c.ConfAPI, c.Breaker),
 		},
 	}, nil
 }
 
-func (task *MultiKeyFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error) {
-	config := task.config
+// multiKeyTaskName join sorted file names as task name
+func multiKeyTaskName(key2ConfFile map[string]string) string {
+	fileNames := []string{}
+	for _, fileName := range key2ConfFile {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	return strings.Join(fileNames, ",")
+}
 
+func (task *MultiKeyFileTask) Name() string {
+	return task.commonConfig.TaskName
+}
+
+func (task *MultiKeyFileTask) BreakerStatus() BreakerStatus {
+	return task.commonConfig.Breaker.status()
+}
+
+func (task *MultiKeyFileTask) WatchTimeout() time.Duration {
+	return task.commonConfig.ConfTaskWatchTimeout
+}
+
+func (task *MultiKeyFileTask) Watch(ctx context.Context) (bool, error) {
+	localVersion, err := task.localVersion()
+	if err != nil {
+		return false, err
+	}
+
+	raw, err := obtainRemoteConfig(ctx, task.commonConfig, task.config.ConfAPI, localVersion, task.WatchTimeout())
+	if err != nil {
+		return false, err
+	}
+
+	return raw != nil && string(raw) != `null`, nil
+}
+
+// localVersion returns the newest version of local conf files
+func (task *MultiKeyFileTask) localVersion() (string, error) {
 	localVersion := ""
-	for _, fileName := range config.Key2ConfFile {
-		version, err := loadLocalVersion(path.Join(config.ConfDir, fileName))
+	for _, fileName := range task.config.Key2ConfFile {
+		version, err := loadLocalVersion(path.Join(task.config.ConfDir, fileName))
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 
 		if version > localVersion {
@@ -55,8 +112,19 @@ func (task *MultiKeyFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileR
 		}
 	}
 
+	return localVersion, nil
+}
+
+func (task *MultiKeyFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error) {
+	config := task.config
+
+	localVersion, err := task.localVersion()
+	if err != nil {
+		return nil, err
+	}
+
 	// obtain config data
-	raw, err := obtainRemoteConfig(ctx, task.commonConfig, config.ConfAPI, localVersion)
+	raw, err := obtainRemoteConfig(ctx, task.commonConfig, config.ConfAPI, localVersion, 0)
 	if err != nil {
 		return nil, err
 	}
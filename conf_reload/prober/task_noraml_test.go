@@ -14,7 +14,22 @@
 
 package prober
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xlog"
+)
 
 func Test_justKeepNumber(t *testing.T) {
 	tests := []struct {
@@ -63,3 +78,222 @@ func Test_justKeepNumber(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalFileTaskNotModified(t *testing.T) {
+	data := "null"
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf("%q", data)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"ErrNum": 200, "Data": %s}`, data)
+	}))
+	defer server.Close()
+
+	task, err := NewNormalFileTask(config.NormalFileTaskConfig{
+		ConfDir:         t.TempDir(),
+		ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+		ConfAPI:         "/conf",
+		ConfFileName:    "a.data",
+		ConfTaskTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		files, err := task.FetchConfFiles(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("got %d files, want no update", len(files))
+		}
+	}
+	if notModified != 2 {
+		t.Errorf("got %d not modified responses, want 2", notModified)
+	}
+
+	// validator of response with newer config is not remembered
+	data = `{"Version": "1"}`
+	for i := 0; i < 2; i++ {
+		files, err := task.FetchConfFiles(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("got %d files, want 1", len(files))
+		}
+	}
+}
+
+func TestNormalFileTaskWatch(t *testing.T) {
+	wait := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait = r.URL.Query().Get("wait")
+		fmt.Fprint(w, `{"ErrNum": 200, "Data": {"Version": "2"}}`)
+	}))
+	defer server.Close()
+
+	task, err := NewNormalFileTask(config.NormalFileTaskConfig{
+		ConfDir:              t.TempDir(),
+		ConfServer:           config.EndpointConfig{Endpoints: []string{server.URL}},
+		ConfAPI:              "/conf",
+		ConfFileName:         "a.data",
+		ConfTaskTimeout:      time.Second,
+		ConfTaskWatchTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := task.Watch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Errorf("want newer config found by watch")
+	}
+	if wait != "30s" {
+		t.Errorf("got wait %s, want 30s", wait)
+	}
+
+	// watch is not used by fetch
+	if _, err := task.FetchConfFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if wait != "" {
+		t.Errorf("got wait %s, want empty", wait)
+	}
+}
+
+func TestNormalFileTaskPost(t *testing.T) {
+	var state confState
+	method := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"ErrNum": 200, "Data": null}`)
+	}))
+	defer server.Close()
+
+	confDir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(confDir, "a.data"), []byte(`{"Version": "1"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := NewNormalFileTask(config.NormalFileTaskConfig{
+		BFECluster:      "cluster",
+		ConfDir:         confDir,
+		ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+		ConfAPI:         "/conf",
+		ConfFileName:    "a.data",
+		ConfTaskTimeout: time.Second,
+		ConfAPIMethod:   http.MethodPost,
+		ReloaderFiles:   []string{"a.data", "b.data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := xlog.NewContext(context.Background(), "server_data_conf")
+	if _, err := task.FetchConfFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if method != http.MethodPost {
+		t.Errorf("method = %s, want POST", method)
+	}
+	if state.BFECluster != "cluster" || state.Reloader != "server_data_conf" || state.Hostname == "" {
+		t.Errorf("state = %+v", state)
+	}
+	if !reflect.DeepEqual(state.Versions, map[string]string{"a.data": "1", "b.data": ""}) {
+		t.Errorf("versions = %v", state.Versions)
+	}
+}
+
+func TestNormalFileTaskWatchBreaker(t *testing.T) {
+	var lock sync.Mutex
+	fail := true
+	watching, release := make(chan struct{}, 1), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("wait") != "" {
+			watching <- struct{}{}
+			<-release
+			fmt.Fprint(w, `{"ErrNum": 200, "Data": {"Version": "2"}}`)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"ErrNum": 200, "Data": null}`)
+	}))
+	defer server.Close()
+	setFail := func(f bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		fail = f
+	}
+
+	task, err := NewNormalFileTask(config.NormalFileTaskConfig{
+		ConfDir:              t.TempDir(),
+		ConfServer:           config.EndpointConfig{Endpoints: []string{server.URL}},
+		ConfAPI:              "/conf",
+		ConfFileName:         "a.data",
+		ConfTaskTimeout:      time.Second,
+		ConfTaskWatchTimeout: 30 * time.Second,
+		Breaker:              config.BreakerConfig{FailureThreshold: 1, Cooldown: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	state := func() BreakerState { return task.BreakerStatus().State }
+
+	// watch doesn't take the probe call after cooldown
+	if _, err := task.FetchConfFiles(ctx); err == nil {
+		t.Fatal("want error when conf server fail")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := task.Watch(ctx); err == nil {
+		t.Errorf("Watch() error = nil, want short-circuited when breaker is not closed")
+	}
+	setFail(false)
+	if _, err := task.FetchConfFiles(ctx); err != nil {
+		t.Fatalf("probe call after cooldown error = %v", err)
+	}
+	if state() != BreakerClosed {
+		t.Fatalf("got state %s, want closed", state())
+	}
+
+	// result of a held watch request doesn't close the breaker opened meanwhile
+	watched := make(chan error, 1)
+	go func() {
+		_, err := task.Watch(ctx)
+		watched <- err
+	}()
+	<-watching
+	setFail(true)
+	if _, err := task.FetchConfFiles(ctx); err == nil {
+		t.Fatal("want error when conf server fail")
+	}
+	close(release)
+	if err := <-watched; err != nil {
+		t.Errorf("Watch() error = %v", err)
+	}
+	if state() != BreakerOpen {
+		t.Errorf("got state %s, want open", state())
+	}
+}
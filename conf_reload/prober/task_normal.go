@@ -25,6 +25,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"time"
 
 	"github.com/baidu/conf-agent/config"
 	"github.com/baidu/conf-agent/xhttp"
@@ -38,16 +39,59 @@ type NormalFileTask struct {
 }
 
 func NewNormalFileTask(c config.NormalFileTaskConfig) (*NormalFileTask, error) {
+	transport, err := xhttp.GetTransport(c.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
 	return &NormalFileTask{
 		config: c,
 		commonConfig: commonConfig{
+			TaskName:        c.ConfFileName,
 			BFECluster:      c.BFECluster,
 			ConfTaskHeaders: c.ConfTaskHeaders,
 			ConfTaskTimeout: c.ConfTaskTimeout,
+			Validators:      xhttp.NewValidatorCache(),
+
+			ConfTaskWatchTimeout: c.ConfTaskWatchTimeout,
+			ConfAPIMethod:        c.ConfAPIMethod,
+			ConfDir:              c.ConfDir,
+			ReloaderFiles:        c.ReloaderFiles,
+			MaxConfResponseBytes: c.MaxConfResponseBytes,
+			HTTPRetry:            c.HTTPRetry,
+			ConfServer:           newEndpointPool(c.ConfServer),
+			Transport:            transport,
+			Breaker:              newCircuitBreaker(c.ConfAPI, c.Breaker),
 		},
 	}, nil
 }
 
+func (task *NormalFileTask) Name() string {
+	return task.commonConfig.TaskName
+}
+
+func (task *NormalFileTask) BreakerStatus() BreakerStatus {
+	return task.commonConfig.Breaker.status()
+}
+
+func (task *NormalFileTask) WatchTimeout() time.Duration {
+	return task.commonConfig.ConfTaskWatchTimeout
+}
+
+func (task *NormalFileTask) Watch(ctx context.Context) (bool, error) {
+	localVersion, err := loadLocalVersion(path.Join(task.config.ConfDir, task.config.ConfFileName))
+	if err != nil {
+		return false, err
+	}
+
+	raw, err := obtainRemoteConfig(ctx, task.commonConfig, task.config.ConfAPI, localVersion, task.WatchTimeout())
+	if err != nil {
+		return false, err
+	}
+
+	return raw != nil && string(raw) != `null`, nil
+}
+
 func (task *NormalFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileResult, error) {
 	config := task.config
 	fileName := config.ConfFileName
@@ -58,7 +102,7 @@ func (task *NormalFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileRes
 	}
 
 	// obtain config data
-	raw, err := obtainRemoteConfig(ctx, task.commonConfig, config.ConfAPI, localVersion)
+	raw, err := obtainRemoteConfig(ctx, task.commonConfig, config.ConfAPI, localVersion, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +126,30 @@ func (task *NormalFileTask) FetchConfFiles(ctx context.Context) ([]*FetchFileRes
 	}, nil
 }
 
-func obtainRemoteConfig(ctx context.Context, config commonConfig, apiURL, localVersion string) ([]byte, error) {
+// obtainRemoteConfig obtains config newer than localVersion.
+// If wait > 0, it's a watch request, conf server holds it until newer config exists or wait,
+// conditional request is not used for watch.
+// Requests are short-circuited while circuit breaker of apiURL is open,
+// watch requests are short-circuited unless it's closed and don't affect it.
+func obtainRemoteConfig(ctx context.Context, config commonConfig, apiURL, localVersion string, wait time.Duration) ([]byte, error) {
+	if wait > 0 {
+		if err := config.Breaker.allowWatch(); err != nil {
+			return nil, err
+		}
+		return requestRemoteConfig(ctx, config, apiURL, localVersion, wait)
+	}
+
+	if err := config.Breaker.allow(ctx); err != nil {
+		return nil, err
+	}
+
+	raw, err := requestRemoteConfig(ctx, config, apiURL, localVersion, wait)
+	config.Breaker.record(ctx, err)
+
+	return raw, err
+}
+
+func requestRemoteConfig(ctx context.Context, config commonConfig, apiURL, localVersion string, wait time.Duration) ([]byte, error) {
 	/* response data look like:
 	{
 		"ErrNum": 200,
@@ -99,30 +166,102 @@ func obtainRemoteConfig(ctx context.Context, config commonConfig, apiURL, localV
 	params := url.Values{}
 	params.Add("version", localVersion)
 	params.Add("bfe_cluster", config.BFECluster)
+	validator := config.Validators.Get(apiURL + "?" + params.Encode())
+	if wait > 0 {
+		params.Add("wait", wait.String())
+		validator = xhttp.Validator{}
+	}
 	requestURL := apiURL + "?" + params.Encode()
 
+	requestOp := xhttp.SimpleRequestOp(http.MethodGet, requestURL, nil)
+	if config.ConfAPIMethod == http.MethodPost {
+		state, err := loadConfState(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		requestOp = xhttp.JSONRequestOp(http.MethodPost, requestURL, state)
+		// response of POST is not cached
+		validator = xhttp.Validator{}
+	}
+
 	req := xhttp.NewHTTPRequest().
 		Decorate(
-			xhttp.HTTPRequestTimeoutOp(config.ConfTaskTimeout),
-			xhttp.SimpleRequestOp(http.MethodGet, requestURL, nil),
-			xhttp.HTTPRequestHeaderOp(config.ConfTaskHeaders)).
+			xhttp.HTTPRequestContextOp(ctx),
+			xhttp.HTTPRequestTimeoutOp(config.ConfTaskTimeout+wait),
+			xhttp.HTTPRequestMaxBodySizeOp(config.MaxConfResponseBytes),
+			xhttp.HTTPRequestRetryOp(config.HTTPRetry.Attempts, config.HTTPRetry.Backoff),
+			requestOp,
+			xhttp.HTTPRequestEndpointOp(config.ConfServer),
+			xhttp.HTTPRequestTransportOp(config.Transport),
+			xhttp.HTTPRequestHeaderOp(config.ConfTaskHeaders),
+			xhttp.ConditionalRequestOp(validator)).
 		Do().
 		Decorate(
 			xhttp.RspBodyRawReaderOp,
-			xhttp.RspCode200Op,
-			xhttp.RspBodyJSONReader(&rsp),
+			xhttp.RspCode200Or304Op,
 		)
 
+	recordDownloadBytes(ctx, config.TaskName, req.BodySize())
+
 	if err := req.Err(); err != nil {
 		return nil, err
 	}
 
+	// same as null, no newer config
+	if req.NotModified() {
+		xlog.Default.Debug(xlog.InfoLogFormat(ctx, "obtainRemoteConfig", "url: ", requestURL, " not modified"))
+		return nil, nil
+	}
+
+	if err := req.Decorate(xhttp.RspBodyJSONReader(&rsp)).Err(); err != nil {
+		return nil, err
+	}
+
 	xlog.Default.Debug(
 		xlog.InfoLogFormat(ctx, "obtainRemoteConfig", "url: ", requestURL, " fileContent: ", string(req.RawContent)))
 
+	// only remember validator of response without newer config, if newer config fails to apply,
+	// local version is unchanged and it must be obtained again
+	if wait > 0 || config.ConfAPIMethod == http.MethodPost {
+		return rsp.Data, nil
+	}
+	if rsp.Data == nil || string(rsp.Data) == `null` {
+		config.Validators.Set(requestURL, req.Validator())
+	} else {
+		config.Validators.Set(requestURL, xhttp.Validator{})
+	}
+
 	return rsp.Data, nil
 }
 
+// confState is the body of POST conf API, it tells conf server what agent has
+type confState struct {
+	BFECluster string `json:"bfe_cluster"`
+	Hostname   string `json:"hostname"`
+	Reloader   string `json:"reloader"`
+	// Versions is the current version of every conf file of reloader, empty if file not exist
+	Versions map[string]string `json:"versions"`
+}
+
+func loadConfState(ctx context.Context, config commonConfig) (*confState, error) {
+	state := &confState{
+		BFECluster: config.BFECluster,
+		Hostname:   xhttp.Identity().Hostname,
+		Reloader:   xlog.ReloaderName(ctx),
+		Versions:   map[string]string{},
+	}
+
+	for _, fileName := range config.ReloaderFiles {
+		version, err := loadLocalVersion(path.Join(config.ConfDir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		state.Versions[fileName] = version
+	}
+
+	return state, nil
+}
+
 func loadLocalVersion(fileName string) (string, error) {
 	bs, err := ioutil.ReadFile(fileName)
 	if os.IsNotExist(err) {
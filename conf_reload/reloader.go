@@ -16,13 +16,19 @@ package conf_reload
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"math/rand"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/baidu/conf-agent/conf_reload/file_store"
 	"github.com/baidu/conf-agent/conf_reload/prober"
 	"github.com/baidu/conf-agent/conf_reload/trigger"
 	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xbackoff"
+	"github.com/baidu/conf-agent/xdiff"
 	"github.com/baidu/conf-agent/xlog"
 )
 
@@ -32,13 +38,32 @@ type Reloader struct {
 	// ReloadInterval is the interval reloader try to reload
 	ReloadInterval time.Duration
 
+	// retryBackoff decides the delay after failed reload cycles
+	retryBackoff xbackoff.Backoff
+	// triggerRetryDelay replaces retryBackoff.Min when only bfe reload fails
+	triggerRetryDelay time.Duration
+
 	prober    *prober.Prober
 	trigger   *trigger.Trigger
 	fileStore *file_store.FileStore
+	// confFiles is the conf files of tasks, only they are diffed in DryRun
+	confFiles map[string]bool
+
+	freezer *freezer
+
+	// cycleLock serializes reload cycles and rollbacks of this process
+	cycleLock sync.Mutex
+	// storedHook is called after files of a reload cycle are stored, it's nil except in tests
+	storedHook func()
+
+	// kick wakes up Start to run a reload cycle at once, kicks before the cycle begin are merged
+	kick chan struct{}
+
+	status statusRecorder
 }
 
 func NewReloader(rc *config.ReloaderConfig) (*Reloader, error) {
-	prober, err := prober.NewProber(rc.NormalFileTasks, rc.MultiJSONKeyFileTasks, rc.ExtraFileFileTasks)
+	prober, err := prober.NewProber(rc.Probe, rc.NormalFileTasks, rc.MultiJSONKeyFileTasks, rc.ExtraFileFileTasks)
 	if err != nil {
 		return nil, err
 	}
@@ -48,80 +73,490 @@ func NewReloader(rc *config.ReloaderConfig) (*Reloader, error) {
 		return nil, err
 	}
 
-	fileStore, err := file_store.NewFileStore(rc.ConfDir, rc.CopyFiles)
+	fileStore, err := file_store.NewFileStore(rc.ConfDir, rc.CopyFiles, file_store.RetentionPolicy{
+		Count:  rc.RetainVersionCount,
+		MaxAge: rc.RetainVersionAge,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return &Reloader{
+	reloader := &Reloader{
 		Name:           rc.Name,
 		ReloadInterval: rc.ReloadInterval,
 
+		retryBackoff:      rc.RetryBackoff,
+		triggerRetryDelay: rc.TriggerRetryDelay,
+
 		prober:    prober,
 		trigger:   trigger,
 		fileStore: fileStore,
-	}, nil
+		confFiles: map[string]bool{},
+
+		freezer: &freezer{
+			windows: rc.FreezeWindows,
+			files:   rc.FreezeFiles,
+		},
+
+		kick: make(chan struct{}, 1),
+	}
+	for _, name := range rc.ConfFiles {
+		reloader.confFiles[name] = true
+	}
+	reloader.updateAppliedVersion()
+
+	return reloader, nil
 }
 
-func (r *Reloader) Start() {
+// Start runs reload cycles every ReloadInterval until ctx is done.
+// Tasks enabling watch run a reload cycle as soon as conf server has newer config.
+// An in-progress reload cycle is never interrupted, Start returns after it finished.
+func (r *Reloader) Start(ctx context.Context) {
+	// clean version directories left by last run
+	r.fileStore.Prune(xlog.NewContext(context.Background(), r.Name))
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, watcher := range r.prober.Watchers() {
+		wg.Add(1)
+		go func(watcher prober.Watcher) {
+			defer wg.Done()
+			r.watch(ctx, watcher)
+		}(watcher)
+	}
+
 	// don't request config sever at the same time
-	time.Sleep(time.Duration(rand.Int()%int(r.ReloadInterval/time.Millisecond)) * time.Millisecond)
+	if !r.wait(ctx, time.Duration(rand.Int()%int(r.ReloadInterval/time.Millisecond))*time.Millisecond) {
+		return
+	}
 
 	for {
-		r.reload(xlog.NewContext(context.Background(), r.Name))
+		cycleCtx := xlog.NewContext(context.Background(), r.Name)
+		outcome := r.reload(cycleCtx)
+
+		delay := r.nextDelay(outcome)
+		if outcome.Failed() {
+			xlog.Default.Info(xlog.InfoLogFormat(cycleCtx, "reload retry", "after ", delay.String()))
+		}
 
-		time.Sleep(r.ReloadInterval)
+		if !r.wait(ctx, delay) {
+			return
+		}
 	}
 }
 
-func (r *Reloader) reload(ctx context.Context) {
+// nextDelay returns the delay before next reload cycle.
+// After failures it backs off from retryBackoff.Min, or triggerRetryDelay if only bfe reload failed,
+// and resets to ReloadInterval once a cycle succeeds.
+func (r *Reloader) nextDelay(outcome Outcome) time.Duration {
+	if !outcome.Failed() {
+		return r.ReloadInterval
+	}
+
+	backoff := r.retryBackoff
+	if outcome == OutcomeTriggerFailed {
+		backoff.Min = r.triggerRetryDelay
+	}
+
+	return backoff.Delay(r.status.get().ConsecutiveFailures)
+}
+
+// Kick makes Start run a reload cycle at once.
+// It never blocks, a burst of kicks causes a single cycle.
+func (r *Reloader) Kick() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for d or Kick, return false if ctx is done before that
+func (r *Reloader) wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	case <-r.kick:
+		return true
+	}
+}
+
+// watch runs a reload cycle whenever watcher finds newer config, until ctx is done.
+// If conf server replies without holding the request, watch is not supported,
+// reloader falls back to interval polling.
+func (r *Reloader) watch(ctx context.Context, watcher prober.Watcher) {
+	for {
+		// every watch request has its own LogID
+		watchCtx := xlog.NewContext(ctx, r.Name)
+
+		begin := time.Now()
+		updated, err := watcher.Watch(watchCtx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			xlog.Default.Error(xlog.ErrLogFormat(watchCtx, "watch "+watcher.Name(), err))
+			if !xbackoff.Sleep(ctx, r.ReloadInterval) {
+				return
+			}
+			continue
+		}
+
+		if !updated {
+			if time.Since(begin) < watcher.WatchTimeout()/2 {
+				xlog.Default.Info(xlog.InfoLogFormat(watchCtx, "watch "+watcher.Name(), "not supported by conf server, fall back to interval polling"))
+				return
+			}
+			continue
+		}
+
+		xlog.Default.Info(xlog.InfoLogFormat(watchCtx, "watch "+watcher.Name(), "newer config found"))
+		outcome, _ := r.runCycle(xlog.NewContext(context.Background(), r.Name), cycleOptions{})
+
+		// newer config is not applied, such as pinned or frozen, don't watch again at once
+		if outcome != OutcomeUpdated && !xbackoff.Sleep(ctx, r.ReloadInterval) {
+			return
+		}
+	}
+}
+
+// cycleOptions changes the behavior of a reload cycle
+type cycleOptions struct {
+	// skipTrigger skips TriggerBFEReload, used when bfe is not running yet
+	skipTrigger bool
+}
+
+func (r *Reloader) reload(ctx context.Context) Outcome {
+	outcome, _ := r.runCycle(ctx, cycleOptions{})
+	return outcome
+}
+
+// SyncOnce runs a reload cycle without triggering bfe reload.
+// It's used to bootstrap conf before bfe starts, so fail to update ConfDir is an error as well.
+func (r *Reloader) SyncOnce(ctx context.Context) error {
+	_, err := r.runCycle(ctx, cycleOptions{skipTrigger: true})
+	return err
+}
+
+func (r *Reloader) runCycle(ctx context.Context, opts cycleOptions) (Outcome, error) {
+	r.cycleLock.Lock()
+	defer r.cycleLock.Unlock()
+
+	outcome, version, err := r.doReload(ctx, opts)
+
+	// newer version which is not applied
+	availableVersion := ""
+	if outcome == OutcomePinned || outcome == OutcomeFrozen {
+		availableVersion = version
+	}
+	r.status.record(outcome, availableVersion, err)
+
+	// clean version directories of failed cycle, succ cycle has pruned in UpdateDefaultConfDir
+	if outcome == OutcomeStoreFailed || outcome == OutcomeTriggerFailed {
+		r.fileStore.Prune(ctx)
+	}
+	r.observeCycle(outcome)
+
+	return outcome, err
+}
+
+// doReload runs a reload cycle, returns its outcome and the newer version found by probe
+func (r *Reloader) doReload(ctx context.Context, opts cycleOptions) (Outcome, string, error) {
 	xlog.Default.Info(xlog.InfoLogFormat(ctx, "reload begin"))
 
 	// fetch newer data file
+	begin := time.Now()
 	fileList, err := r.prober.Probe(ctx)
+	r.observePhase(phaseProbe, begin, err)
 	if err != nil {
 		xlog.Default.Error(xlog.ErrLogFormat(ctx, "probe", err))
-		return
+		return OutcomeProbeFailed, "", err
 	}
 	xlog.Default.Info(xlog.InfoLogFormat(ctx, "probe succ"))
 
 	// no newer data file, exit
 	if len(fileList) == 0 {
 		xlog.Default.Info(xlog.InfoLogFormat(ctx, "reload succ", "without_update"))
-		return
+		return OutcomeNoUpdate, "", nil
 	}
 
-	version := ""
-	files := map[string][]byte{}
-	for _, one := range fileList {
-		files[one.Name] = one.Content
-		if one.Version > version {
-			version = one.Version
-		}
+	version, files := mergeFileList(fileList)
+
+	// pinned by rollback, don't roll forward until unpin
+	if outcome, err := r.checkPinned(ctx, version); outcome != "" {
+		return outcome, version, err
+	}
+
+	// frozen, probe only
+	if reason := r.freezer.frozenReason(time.Now()); reason != "" {
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "reload skip", "frozen by ", reason, ", newer version ", version))
+		return OutcomeFrozen, version, nil
 	}
 
 	// store all newer data file
+	begin = time.Now()
 	err = r.fileStore.StoreFile2TmpDir(ctx, version, files)
+	r.observePhase(phaseStoreFile2TmpDir, begin, err)
 	if err != nil {
 		xlog.Default.Error(xlog.ErrLogFormat(ctx, "StoreFile2TmpDir fail", err))
-		return
+		return OutcomeStoreFailed, version, err
 	}
 	xlog.Default.Info(xlog.InfoLogFormat(ctx, "StoreFile2TmpDir succ"))
+	if r.storedHook != nil {
+		r.storedHook()
+	}
+
+	// rollback of another process may pin during the cycle
+	if outcome, err := r.checkPinned(ctx, version); outcome != "" {
+		return outcome, version, err
+	}
 
 	// trigger bfe reload
-	err = r.trigger.TriggerBFEReload(ctx, version)
-	if err != nil {
-		xlog.Default.Error(xlog.ErrLogFormat(ctx, "TriggerBFEReload fail", err))
-		return
+	if opts.skipTrigger {
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "TriggerBFEReload skip"))
+	} else {
+		begin = time.Now()
+		err = r.trigger.TriggerBFEReload(ctx, version)
+		r.observePhase(phaseTriggerBFEReload, begin, err)
+		if err != nil {
+			xlog.Default.Error(xlog.ErrLogFormat(ctx, "TriggerBFEReload fail", err))
+			return OutcomeTriggerFailed, version, err
+		}
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "TriggerBFEReload succ"))
+	}
+
+	// don't link ConfDir over the version of rollback
+	if outcome, err := r.checkPinned(ctx, version); outcome != "" {
+		return outcome, version, err
 	}
-	xlog.Default.Info(xlog.InfoLogFormat(ctx, "TriggerBFEReload succ"))
 
 	// replace old config by newest, if fail, it's ok
+	begin = time.Now()
 	err = r.fileStore.UpdateDefaultConfDir(ctx, version)
+	r.observePhase(phaseUpdateDefaultConfDir, begin, err)
 	if err != nil {
 		xlog.Default.Error(xlog.ErrLogFormat(ctx, "UpdateDefaultConfDir fail", err))
+	} else {
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "UpdateDefaultConfDir succ"))
+		r.updateAppliedVersion()
 	}
-	xlog.Default.Info(xlog.InfoLogFormat(ctx, "UpdateDefaultConfDir succ"))
 
 	xlog.Default.Info(xlog.InfoLogFormat(ctx, "reload succ", "update"))
+	return OutcomeUpdated, version, err
+}
+
+// checkPinned reads the pin file, returns the outcome to abort the cycle with if pinned or fail, otherwise "".
+// The pin file is read again before each step of a cycle, since rollback of another process isn't serialized by cycleLock.
+func (r *Reloader) checkPinned(ctx context.Context, version string) (Outcome, error) {
+	pinned, err := r.fileStore.PinnedVersion()
+	if err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "PinnedVersion", err))
+		return OutcomeStoreFailed, err
+	}
+	if pinned != "" {
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "reload skip", "pinned to version ", pinned, ", newer version ", version))
+		return OutcomePinned, nil
+	}
+
+	return "", nil
+}
+
+// mergeFileList returns the newest version of files and content of each file
+func mergeFileList(fileList []*prober.FetchFileResult) (string, map[string]*file_store.ConfFile) {
+	version := ""
+	files := map[string]*file_store.ConfFile{}
+	for _, one := range fileList {
+		files[one.Name] = &file_store.ConfFile{
+			Content: one.Content,
+			Path:    one.Path,
+		}
+		if one.Version > version {
+			version = one.Version
+		}
+	}
+
+	return version, files
+}
+
+// DryRun probes newer files and writes unified diff of conf files against files in ConfDir to w.
+// Extra files, such as certs and keys, are listed by name only.
+// Nothing is stored and bfe is not triggered.
+func (r *Reloader) DryRun(ctx context.Context, w io.Writer) error {
+	fileList, err := r.prober.Probe(prober.WithDryRun(ctx))
+	if err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "probe", err))
+		return err
+	}
+
+	if len(fileList) == 0 {
+		fmt.Fprintf(w, "# reloader %s: no update\n", r.Name)
+		return nil
+	}
+
+	version, files := mergeFileList(fileList)
+	changes, err := r.fileStore.Preview(files)
+	if err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "fileStore.Preview", err))
+		return err
+	}
+
+	currentVersion, _ := r.fileStore.CurrentVersion()
+	fmt.Fprintf(w, "# reloader %s: version %s -> %s, conf dir %s\n", r.Name, currentVersion, version, r.fileStore.ConfDir)
+
+	for _, change := range changes {
+		oldName, newName := "a/"+change.Name, "b/"+change.Name
+		switch {
+		case change.Old == nil:
+			oldName = "/dev/null"
+			fmt.Fprintf(w, "# add %s\n", change.Name)
+		case change.New == nil:
+			newName = "/dev/null"
+			fmt.Fprintf(w, "# remove %s\n", change.Name)
+		default:
+			fmt.Fprintf(w, "# change %s\n", change.Name)
+		}
+
+		// content of extra files may be secret
+		if !r.confFiles[change.Name] {
+			continue
+		}
+		fmt.Fprint(w, xdiff.Unified(oldName, newName, change.Old, change.New, xdiff.DefaultContext))
+	}
+
+	return nil
+}
+
+// VersionList is the retained versions of a reloader
+type VersionList struct {
+	Name string
+	// Current is the version ConfDir currently links to
+	Current string
+	// Pinned is the version reloader is pinned to, empty if not pinned
+	Pinned string
+	// Versions is the retained versions, newest first
+	Versions []string
+}
+
+// Versions lists retained {ConfDir}_{version} directories
+func (r *Reloader) Versions() (*VersionList, error) {
+	versions, err := r.fileStore.Versions()
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := r.fileStore.CurrentVersion()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	pinned, err := r.fileStore.PinnedVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	return &VersionList{
+		Name:     r.Name,
+		Current:  current,
+		Pinned:   pinned,
+		Versions: versions,
+	}, nil
+}
+
+// Rollback reloads bfe with a retained version, links ConfDir to it,
+// then pins the reloader so reload cycles will not roll forward until Unpin.
+func (r *Reloader) Rollback(ctx context.Context, version string) error {
+	r.cycleLock.Lock()
+	defer r.cycleLock.Unlock()
+
+	if !r.fileStore.HasVersion(version) {
+		err := fmt.Errorf("version %s not retained", version)
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Rollback", err))
+		return err
+	}
+
+	// pin first, so reload cycles of another agent process stop rolling forward
+	prevPinned, err := r.fileStore.PinnedVersion()
+	if err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Rollback.PinnedVersion", err))
+		return err
+	}
+	if err := r.fileStore.Pin(version); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Rollback.Pin", err))
+		return err
+	}
+
+	// restore pin state if rollback fail
+	restorePin := func() {
+		if prevPinned != "" {
+			r.fileStore.Pin(prevPinned)
+		} else {
+			r.fileStore.Unpin()
+		}
+	}
+
+	if err := r.trigger.TriggerBFEReload(ctx, version); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Rollback.TriggerBFEReload", err))
+		restorePin()
+		return err
+	}
+
+	if err := r.fileStore.UpdateDefaultConfDir(ctx, version); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Rollback.UpdateDefaultConfDir", err))
+		restorePin()
+		return err
+	}
+	r.updateAppliedVersion()
+
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "Rollback succ", "version ", version))
+	return nil
+}
+
+// Unpin lets reload cycles roll forward again
+func (r *Reloader) Unpin(ctx context.Context) error {
+	if err := r.fileStore.Unpin(); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Unpin", err))
+		return err
+	}
+
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "Unpin succ"))
+	return nil
+}
+
+// Freeze freezes reloader by its marker file
+func (r *Reloader) Freeze(ctx context.Context, reason string) error {
+	if err := FreezeByFile(r.freezer.reloaderFile(), reason); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Freeze", err))
+		return err
+	}
+
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "Freeze succ", reason))
+	return nil
+}
+
+// Unfreeze removes marker file of reloader, reloader is still frozen by freeze windows and global marker file
+func (r *Reloader) Unfreeze(ctx context.Context) error {
+	if err := UnfreezeByFile(r.freezer.reloaderFile()); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Unfreeze", err))
+		return err
+	}
+
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "Unfreeze succ"))
+	return nil
+}
+
+// Status returns the status of reloader
+func (r *Reloader) Status() Status {
+	status := r.status.get()
+	status.Name = r.Name
+	status.Version, _ = r.fileStore.CurrentVersion()
+	status.Pinned, _ = r.fileStore.PinnedVersion()
+	status.Frozen = r.freezer.frozenReason(time.Now())
+	status.Breakers = r.prober.BreakerStatus()
+
+	return status
 }
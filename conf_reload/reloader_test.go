@@ -0,0 +1,446 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/xbackoff"
+	"github.com/baidu/conf-agent/xlog"
+	"github.com/ohler55/ojg/jp"
+)
+
+// testServer serves conf API of a normal task and an extra file task, extra files and reload API of bfe
+type testServer struct {
+	lock sync.Mutex
+	// version is the version of conf files, "" means no update
+	version string
+	// extraFiles is the extra files listed in extra.data
+	extraFiles []string
+	// probeFail makes conf API reply 500
+	probeFail bool
+	// reloadFail makes bfe reload fail
+	reloadFail bool
+	// reloads is the paths of bfe reloads
+	reloads []string
+	// reloadHook is called when bfe reloads, if not nil
+	reloadHook func()
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/conf":
+		if s.probeFail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if s.version == "" {
+			fmt.Fprint(w, `{"ErrNum": 200, "Data": null}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ErrNum": 200, "Data": {"Version": "%s"}}`, s.version)
+
+	case "/extra_conf":
+		if s.version == "" {
+			fmt.Fprint(w, `{"ErrNum": 200, "Data": null}`)
+			return
+		}
+		files, _ := json.Marshal(append([]string{}, s.extraFiles...))
+		fmt.Fprintf(w, `{"ErrNum": 200, "Data": {"Version": "%s", "Files": %s}}`, s.version, files)
+
+	case "/reload":
+		if s.reloadFail {
+			fmt.Fprint(w, `{"error": "reload fail"}`)
+			return
+		}
+		s.reloads = append(s.reloads, r.URL.Query().Get("path"))
+		if s.reloadHook != nil {
+			s.reloadHook()
+		}
+		fmt.Fprint(w, `{"error": null}`)
+
+	default:
+		fmt.Fprintf(w, "secret %s of %s", s.version, r.URL.Path)
+	}
+}
+
+func (s *testServer) set(f func(s *testServer)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f(s)
+}
+
+func (s *testServer) reloadPaths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]string{}, s.reloads...)
+}
+
+// newTestReloader returns a reloader with a normal task a.data and an extra file task extra.data,
+// its ConfDir is {tmp}/conf
+func newTestReloader(t *testing.T, server *httptest.Server) *Reloader {
+	confDir := filepath.Join(t.TempDir(), "conf")
+
+	normal := config.NormalFileTaskConfig{
+		ConfDir:         confDir,
+		ConfServer:      config.EndpointConfig{Endpoints: []string{server.URL}},
+		ConfAPI:         "/conf",
+		ConfFileName:    "a.data",
+		ConfTaskTimeout: time.Second,
+	}
+	extra := config.ExtraFileTaskConfig{
+		NormalFileTaskConfig:     normal,
+		ExtraFileServer:          config.EndpointConfig{Endpoints: []string{server.URL + "/"}},
+		ExtraFileTaskTimeout:     time.Second,
+		ExtraFileTaskConcurrency: 1,
+		JSONPaths:                []jp.Expr{jp.MustParseString("$.Files[*]")},
+	}
+	extra.ConfAPI = "/extra_conf"
+	extra.ConfFileName = "extra.data"
+
+	r, err := NewReloader(&config.ReloaderConfig{
+		Name:           "test",
+		ConfDir:        confDir,
+		ReloadInterval: time.Hour,
+		Trigger: config.TriggerConfig{
+			BFEReloadAPI:     server.URL + "/reload",
+			BFEReloadTimeout: time.Second,
+			ConfDir:          confDir,
+		},
+		Probe:              config.ProbeConfig{Concurrency: 1},
+		ConfFiles:          []string{"a.data", "extra.data"},
+		RetainVersionCount: 5,
+
+		NormalFileTasks:    []*config.NormalFileTaskConfig{&normal},
+		ExtraFileFileTasks: []*config.ExtraFileTaskConfig{&extra},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestReloaderKick(t *testing.T) {
+	r := &Reloader{kick: make(chan struct{}, 1)}
+
+	// a burst of kicks wakes up once
+	for i := 0; i < 3; i++ {
+		r.Kick()
+	}
+
+	begin := time.Now()
+	if !r.wait(context.Background(), time.Hour) {
+		t.Fatal("wait() = false, want true")
+	}
+	if time.Since(begin) > time.Second {
+		t.Errorf("wait() is not woken up by Kick")
+	}
+
+	begin = time.Now()
+	r.wait(context.Background(), 50*time.Millisecond)
+	if time.Since(begin) < 50*time.Millisecond {
+		t.Errorf("kicks are not merged")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r.wait(ctx, time.Hour) {
+		t.Errorf("wait() = true after ctx is done")
+	}
+}
+
+func TestReloaderNextDelay(t *testing.T) {
+	r := &Reloader{
+		ReloadInterval: 10 * time.Second,
+		retryBackoff: xbackoff.Backoff{
+			Min:        5 * time.Second,
+			Max:        time.Minute,
+			Multiplier: 2,
+		},
+		triggerRetryDelay: time.Second,
+	}
+
+	tests := []struct {
+		outcome Outcome
+		want    time.Duration
+	}{
+		{outcome: OutcomeProbeFailed, want: 5 * time.Second},
+		{outcome: OutcomeProbeFailed, want: 10 * time.Second},
+		{outcome: OutcomeStoreFailed, want: 20 * time.Second},
+		{outcome: OutcomeTriggerFailed, want: 8 * time.Second},
+		{outcome: OutcomeProbeFailed, want: time.Minute},
+		// reset on success
+		{outcome: OutcomeNoUpdate, want: 10 * time.Second},
+		{outcome: OutcomeTriggerFailed, want: time.Second},
+		{outcome: OutcomeUpdated, want: 10 * time.Second},
+	}
+	for i, tt := range tests {
+		r.status.record(tt.outcome, "", nil)
+		if got := r.nextDelay(tt.outcome); got != tt.want {
+			t.Errorf("case %d: nextDelay(%s) = %v, want %v", i, tt.outcome, got, tt.want)
+		}
+	}
+}
+
+func TestReloaderDryRun(t *testing.T) {
+	s := &testServer{version: "1", extraFiles: []string{"certs_1/key.pem", "certs_1/old.pem"}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	r := newTestReloader(t, server)
+	if err := r.SyncOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	s.set(func(s *testServer) {
+		s.version = "2"
+		s.extraFiles = []string{"certs_2/key.pem", "certs_2/new.pem"}
+	})
+	var out bytes.Buffer
+	if err := r.DryRun(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+
+	for _, want := range []string{
+		"# change a.data\n",
+		`+{"Version": "2"}`,
+		"# change key.pem\n",
+		"# add new.pem\n",
+		"# remove old.pem\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output does not contain %q:\n%s", want, got)
+		}
+	}
+	// content of extra files is never printed
+	if strings.Contains(got, "secret") {
+		t.Errorf("output contains content of extra files:\n%s", got)
+	}
+}
+
+func TestReloaderRollback(t *testing.T) {
+	s := &testServer{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	r := newTestReloader(t, server)
+	ctx := context.Background()
+	confDir := r.fileStore.ConfDir
+
+	assertState := func(current, pinned string) {
+		t.Helper()
+		versions, err := r.Versions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if versions.Current != current || versions.Pinned != pinned {
+			t.Errorf("current %q pinned %q, want current %q pinned %q", versions.Current, versions.Pinned, current, pinned)
+		}
+	}
+
+	for _, version := range []string{"1", "2"} {
+		s.set(func(s *testServer) { s.version = version })
+		if outcome := r.reload(ctx); outcome != OutcomeUpdated {
+			t.Fatalf("reload version %s: got %s, want %s", version, outcome, OutcomeUpdated)
+		}
+	}
+	assertState("2", "")
+
+	// unknown version is rejected without touching pin and bfe
+	if err := r.Rollback(ctx, "3"); err == nil || !strings.Contains(err.Error(), "not retained") {
+		t.Errorf("Rollback(3) error = %v, want not retained", err)
+	}
+	assertState("2", "")
+
+	if err := r.Rollback(ctx, "1"); err != nil {
+		t.Fatalf("Rollback(1) error = %v", err)
+	}
+	assertState("1", "1")
+	want := []string{confDir + "_1", confDir + "_2", confDir + "_1"}
+	if got := s.reloadPaths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("bfe reloaded %v, want %v", got, want)
+	}
+
+	// pinned reloader doesn't roll forward
+	s.set(func(s *testServer) { s.version = "3" })
+	if outcome := r.reload(ctx); outcome != OutcomePinned {
+		t.Errorf("reload when pinned: got %s, want %s", outcome, OutcomePinned)
+	}
+	if status := r.Status(); status.AvailableVersion != "3" {
+		t.Errorf("AvailableVersion = %q, want 3", status.AvailableVersion)
+	}
+	assertState("1", "1")
+
+	// previous pin is restored if bfe reload fail
+	s.set(func(s *testServer) { s.reloadFail = true })
+	if err := r.Rollback(ctx, "2"); err == nil {
+		t.Errorf("Rollback(2) error = nil, want bfe reload error")
+	}
+	assertState("1", "1")
+
+	// not pinned before, rollback failure leaves it not pinned
+	if err := r.Unpin(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Rollback(ctx, "2"); err == nil {
+		t.Errorf("Rollback(2) error = nil, want bfe reload error")
+	}
+	assertState("1", "")
+
+	// unpinned reloader rolls forward
+	s.set(func(s *testServer) { s.reloadFail = false })
+	if outcome := r.reload(ctx); outcome != OutcomeUpdated {
+		t.Errorf("reload after unpin: got %s, want %s", outcome, OutcomeUpdated)
+	}
+	assertState("3", "")
+}
+
+func TestReloaderPinnedDuringCycle(t *testing.T) {
+	s := &testServer{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	r := newTestReloader(t, server)
+	ctx := context.Background()
+	confDir := r.fileStore.ConfDir
+
+	s.set(func(s *testServer) { s.version = "1" })
+	if outcome := r.reload(ctx); outcome != OutcomeUpdated {
+		t.Fatalf("reload version 1: got %s, want %s", outcome, OutcomeUpdated)
+	}
+
+	assertAborted := func(wantReloads []string) {
+		t.Helper()
+		if outcome := r.reload(ctx); outcome != OutcomePinned {
+			t.Errorf("reload: got %s, want %s", outcome, OutcomePinned)
+		}
+		if got := s.reloadPaths(); !reflect.DeepEqual(got, wantReloads) {
+			t.Errorf("bfe reloaded %v, want %v", got, wantReloads)
+		}
+		if versions, _ := r.Versions(); versions.Current != "1" {
+			t.Errorf("current version = %q, want 1", versions.Current)
+		}
+		if err := r.Unpin(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another process pins between probe and bfe reload
+	r.storedHook = func() { r.fileStore.Pin("1") }
+	s.set(func(s *testServer) { s.version = "2" })
+	assertAborted([]string{confDir + "_1"})
+	r.storedHook = nil
+
+	// another process pins during bfe reload, ConfDir is not linked to the newer version
+	s.set(func(s *testServer) {
+		s.version = "3"
+		s.reloadHook = func() { r.fileStore.Pin("1") }
+	})
+	assertAborted([]string{confDir + "_1", confDir + "_3"})
+}
+
+func TestReloaderSyncOnce(t *testing.T) {
+	s := &testServer{version: "1", extraFiles: []string{"certs_1/key.pem"}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	r := newTestReloader(t, server)
+	if err := r.SyncOnce(context.Background()); err != nil {
+		t.Fatalf("SyncOnce() error = %v", err)
+	}
+	if version, _ := r.fileStore.CurrentVersion(); version != "1" {
+		t.Errorf("CurrentVersion() = %s, want 1", version)
+	}
+	// bfe is not running yet
+	if got := s.reloadPaths(); len(got) != 0 {
+		t.Errorf("bfe reloaded %v, want not triggered", got)
+	}
+
+	// no update is not a failure
+	s.set(func(s *testServer) { s.version = "" })
+	if err := r.SyncOnce(context.Background()); err != nil {
+		t.Errorf("SyncOnce() without update error = %v", err)
+	}
+
+	s.set(func(s *testServer) { s.probeFail = true })
+	if err := r.SyncOnce(context.Background()); err == nil {
+		t.Errorf("SyncOnce() error = nil, want probe error")
+	}
+	if status := r.Status(); status.Outcome != OutcomeProbeFailed {
+		t.Errorf("Outcome = %s, want %s", status.Outcome, OutcomeProbeFailed)
+	}
+}
+
+// idleWatcher replies no update after holding the request for timeout, it records LogID of every request
+type idleWatcher struct {
+	timeout time.Duration
+	logIDs  chan string
+}
+
+func (w *idleWatcher) Name() string                { return "idle" }
+func (w *idleWatcher) WatchTimeout() time.Duration { return w.timeout }
+
+func (w *idleWatcher) Watch(ctx context.Context) (bool, error) {
+	select {
+	case w.logIDs <- xlog.GetLogContext(ctx).LogID:
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	time.Sleep(w.timeout)
+	return false, nil
+}
+
+func TestReloaderWatchLogID(t *testing.T) {
+	r := &Reloader{Name: "test", ReloadInterval: time.Hour}
+	watcher := &idleWatcher{timeout: time.Millisecond, logIDs: make(chan string)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.watch(ctx, watcher)
+		close(done)
+	}()
+
+	logIDs := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		logIDs[<-watcher.logIDs] = true
+	}
+	cancel()
+	<-done
+
+	if len(logIDs) != 3 {
+		t.Errorf("got %d LogIDs of 3 watch requests, want different LogIDs", len(logIDs))
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conf_reload
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baidu/conf-agent/conf_reload/prober"
+)
+
+// Outcome is the result of a reload cycle
+type Outcome string
+
+const (
+	OutcomeProbeFailed   Outcome = "probe_failed"
+	OutcomeStoreFailed   Outcome = "store_failed"
+	OutcomeTriggerFailed Outcome = "trigger_failed"
+	OutcomeNoUpdate      Outcome = "no_update"
+	OutcomeUpdated       Outcome = "updated"
+	OutcomePinned        Outcome = "pinned"
+	OutcomeFrozen        Outcome = "frozen"
+)
+
+// Failed returns true if the reload cycle failed
+func (o Outcome) Failed() bool {
+	return o == OutcomeProbeFailed || o == OutcomeStoreFailed || o == OutcomeTriggerFailed
+}
+
+// Status is the status of a reloader
+type Status struct {
+	Name string
+	// LastCycleTime is the finish time of last reload cycle
+	LastCycleTime time.Time
+	// Outcome is the result of last reload cycle
+	Outcome Outcome
+	// Version is the version ConfDir currently links to
+	Version string
+	// Pinned is the version reloader is pinned to, empty if not pinned
+	Pinned string
+	// Frozen is the reason why reloader is frozen, empty if not frozen
+	Frozen string
+	// AvailableVersion is the newer version found by last cycle but not applied
+	// because reloader is pinned or frozen
+	AvailableVersion string
+
+	// LastError is the text of last error, it's kept after later succ cycles
+	LastError     string
+	LastErrorTime time.Time
+	// ConsecutiveFailures is the count of failed cycles since last succ cycle
+	ConsecutiveFailures int
+
+	// Breakers is the status of circuit breakers of conf apis
+	Breakers []prober.BreakerStatus
+}
+
+// statusRecorder keeps status of a reloader, it's safe for concurrent use
+type statusRecorder struct {
+	lock   sync.Mutex
+	status Status
+}
+
+func (sr *statusRecorder) record(outcome Outcome, availableVersion string, err error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	now := time.Now()
+	sr.status.LastCycleTime = now
+	sr.status.Outcome = outcome
+	sr.status.AvailableVersion = availableVersion
+
+	if err != nil {
+		sr.status.LastError = err.Error()
+		sr.status.LastErrorTime = now
+	}
+
+	if outcome.Failed() {
+		sr.status.ConsecutiveFailures++
+	} else {
+		sr.status.ConsecutiveFailures = 0
+	}
+}
+
+func (sr *statusRecorder) get() Status {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	return sr.status
+}
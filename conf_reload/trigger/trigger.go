@@ -49,6 +49,7 @@ func (trigger *Trigger) TriggerBFEReload(ctx context.Context, version string) er
 
 	req := xhttp.NewHTTPRequest().
 		Decorate(
+			xhttp.HTTPRequestContextOp(ctx),
 			xhttp.HTTPRequestTimeoutOp(trigger.c.BFEReloadTimeout),
 			xhttp.SimpleRequestOp(http.MethodGet, api, nil),
 		).
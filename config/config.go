@@ -19,15 +19,106 @@ import (
 	"sort"
 	"time"
 
+	"github.com/baidu/conf-agent/xbackoff"
 	"github.com/go-playground/validator"
 	"github.com/ohler55/ojg/jp"
 )
 
 type Config struct {
+	Agent     *AgentConfig
 	Reloaders []*ReloaderConfig
 	Logger    *LoggerConfig
 }
 
+type AgentConfig struct {
+	// StopTimeout is the max time to wait for in-progress reload cycles when agent stop
+	StopTimeout time.Duration
+	// AdminAddr is the listen address of admin server, empty means disabled
+	AdminAddr string
+	// AdminToken protects write endpoints of admin server, empty means only loopback clients can write
+	AdminToken string
+	// FreezeFile is the marker file which freezes all reloaders
+	FreezeFile string
+
+	Push PushConfig
+
+	Identity IdentityConfig
+}
+
+// IdentityConfig is the headers sent with every request to identify agent, empty header name means not sent
+type IdentityConfig struct {
+	// RequestIDHeader carries LogID of reload cycle
+	RequestIDHeader  string
+	HostnameHeader   string
+	InstanceIDHeader string
+	ReloaderHeader   string
+
+	// Hostname is hostname of os if not set
+	Hostname   string
+	InstanceID string
+}
+
+// PushConfig is the config of subscribing SSE API of conf server
+type PushConfig struct {
+	ConfServer EndpointConfig
+	// PushAPI is the push API path, empty means push is disabled
+	PushAPI    string
+	BFECluster string
+	Headers    map[string]string
+	HTTPClient HTTPClientConfig
+
+	// ReconnectMin and ReconnectMax limit the backoff of reconnecting
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+}
+
+func newAgentConfig(basic BasicFile) *AgentConfig {
+	ac := &AgentConfig{
+		StopTimeout: time.Duration(basic.StopTimeoutMs) * time.Millisecond,
+		AdminAddr:   basic.AdminAddr,
+		AdminToken:  basic.AdminToken,
+		FreezeFile:  basic.freezeFile(),
+
+		Identity: IdentityConfig{
+			RequestIDHeader:  basic.RequestIDHeader,
+			HostnameHeader:   basic.HostnameHeader,
+			InstanceIDHeader: basic.InstanceIDHeader,
+			ReloaderHeader:   basic.ReloaderHeader,
+			Hostname:         basic.Hostname,
+			InstanceID:       basic.InstanceID,
+		},
+
+		Push: PushConfig{
+			ConfServer:   newEndpointConfig(basic.ConfServer, basic.EndpointStrategy, basic.EndpointCooldownMs),
+			PushAPI:      basic.PushAPI,
+			BFECluster:   basic.BFECluster,
+			Headers:      basic.ConfTaskHeaders,
+			HTTPClient:   newHTTPClientConfig(basic.HTTPClientConfigFile),
+			ReconnectMin: time.Duration(basic.PushReconnectMinMs) * time.Millisecond,
+			ReconnectMax: time.Duration(basic.PushReconnectMaxMs) * time.Millisecond,
+		},
+	}
+
+	return ac
+}
+
+// EndpointConfig is the endpoints of a server and how they are selected
+type EndpointConfig struct {
+	Endpoints []string
+	// Strategy is failover or round_robin
+	Strategy string
+	// Cooldown is the time an endpoint is unhealthy after failure
+	Cooldown time.Duration
+}
+
+func newEndpointConfig(endpoints Endpoints, strategy string, cooldownMs int) EndpointConfig {
+	return EndpointConfig{
+		Endpoints: endpoints,
+		Strategy:  strategy,
+		Cooldown:  time.Duration(cooldownMs) * time.Millisecond,
+	}
+}
+
 type ReloaderConfig struct {
 	Name string
 
@@ -35,8 +126,25 @@ type ReloaderConfig struct {
 	ReloadInterval time.Duration
 
 	Trigger TriggerConfig
+	Probe   ProbeConfig
 
 	CopyFiles []string
+	// ConfFiles is the conf files of all tasks, files not in it are extra files
+	ConfFiles []string
+
+	// FreezeWindows contains windows of both BasicFile and ReloaderConfigFile
+	FreezeWindows []FreezeWindow
+	// FreezeFiles are marker files, reloader is frozen if any of them exists
+	FreezeFiles []string
+
+	// RetainVersionCount and RetainVersionAge decide which {ConfDir}_{version} directories are kept
+	RetainVersionCount int
+	RetainVersionAge   time.Duration
+
+	// RetryBackoff decides the delay after failed reload cycles, instead of ReloadInterval
+	RetryBackoff xbackoff.Backoff
+	// TriggerRetryDelay replaces RetryBackoff.Min when only bfe reload fails
+	TriggerRetryDelay time.Duration
 
 	NormalFileTasks       []*NormalFileTaskConfig
 	MultiJSONKeyFileTasks []*MultiJSONKeyFileTaskConfig
@@ -46,12 +154,26 @@ type ReloaderConfig struct {
 type NormalFileTaskConfig struct {
 	BFECluster string
 
-	ConfDir      string
+	ConfDir string
+	// ConfServer is the endpoints of conf server, ConfAPI is the path of api
+	ConfServer   EndpointConfig
 	ConfAPI      string
 	ConfFileName string
 
 	ConfTaskHeaders map[string]string
 	ConfTaskTimeout time.Duration
+	// ConfTaskWatchTimeout is the max time conf server holds a watch request, 0 means watch is disabled
+	ConfTaskWatchTimeout time.Duration
+	// ConfAPIMethod is GET or POST, see BasicFile.ConfAPIMethod
+	ConfAPIMethod string
+	// MaxConfResponseBytes is the max size of conf API response, 0 means no limit
+	MaxConfResponseBytes int64
+	// ReloaderFiles is the conf files of all tasks of reloader, their versions are posted in POST method
+	ReloaderFiles []string
+
+	HTTPRetry  RetryConfig
+	Breaker    BreakerConfig
+	HTTPClient HTTPClientConfig
 }
 
 func newNormalFileTaskConfig(cf NormalFileTaskConfigFile, rcf ReloaderConfigFile) *NormalFileTaskConfig {
@@ -59,23 +181,50 @@ func newNormalFileTaskConfig(cf NormalFileTaskConfigFile, rcf ReloaderConfigFile
 		BFECluster: rcf.BFECluster,
 		ConfDir:    rcf.ConfDir,
 
-		ConfAPI:      cf.ConfServer + cf.ConfAPI,
+		ConfServer:   newEndpointConfig(cf.ConfServer, cf.EndpointStrategy, cf.EndpointCooldownMs),
+		ConfAPI:      cf.ConfAPI,
 		ConfFileName: cf.ConfFileName,
 
 		ConfTaskHeaders: cf.ConfTaskHeaders,
 		ConfTaskTimeout: time.Duration(cf.ConfTaskTimeoutMs) * time.Millisecond,
+
+		ConfTaskWatchTimeout: time.Duration(cf.ConfTaskWatchTimeoutMs) * time.Millisecond,
+		ConfAPIMethod:        cf.ConfAPIMethod,
+		MaxConfResponseBytes: cf.MaxConfResponseBytes,
+		ReloaderFiles:        rcf.confFileNames(),
+
+		HTTPRetry: newRetryConfig(cf.HTTPRetryAttempts, cf.HTTPRetryBackoffMinMs, cf.HTTPRetryBackoffMaxMs),
+		Breaker: BreakerConfig{
+			FailureThreshold: cf.BreakerFailureThreshold,
+			Cooldown:         time.Duration(cf.BreakerCooldownMs) * time.Millisecond,
+		},
+		HTTPClient: newHTTPClientConfig(cf.HTTPClientConfigFile),
 	}
 }
 
 type MultiJSONKeyFileTaskConfig struct {
 	BFECluster string
 
-	ConfDir      string
+	ConfDir string
+	// ConfServer is the endpoints of conf server, ConfAPI is the path of api
+	ConfServer   EndpointConfig
 	ConfAPI      string
 	Key2ConfFile map[string]string
 
 	ConfTaskHeaders map[string]string
 	ConfTaskTimeout time.Duration
+	// ConfTaskWatchTimeout is the max time conf server holds a watch request, 0 means watch is disabled
+	ConfTaskWatchTimeout time.Duration
+	// ConfAPIMethod is GET or POST, see BasicFile.ConfAPIMethod
+	ConfAPIMethod string
+	// MaxConfResponseBytes is the max size of conf API response, 0 means no limit
+	MaxConfResponseBytes int64
+	// ReloaderFiles is the conf files of all tasks of reloader, their versions are posted in POST method
+	ReloaderFiles []string
+
+	HTTPRetry  RetryConfig
+	Breaker    BreakerConfig
+	HTTPClient HTTPClientConfig
 }
 
 func newMultiJSONKeyFileTaskConfig(cf MultiJSONKeyFileTaskConfigFile, rcf ReloaderConfigFile) *MultiJSONKeyFileTaskConfig {
@@ -83,25 +232,140 @@ func newMultiJSONKeyFileTaskConfig(cf MultiJSONKeyFileTaskConfigFile, rcf Reload
 		BFECluster: rcf.BFECluster,
 
 		ConfDir:      rcf.ConfDir,
-		ConfAPI:      cf.ConfServer + cf.ConfAPI,
+		ConfServer:   newEndpointConfig(cf.ConfServer, cf.EndpointStrategy, cf.EndpointCooldownMs),
+		ConfAPI:      cf.ConfAPI,
 		Key2ConfFile: cf.Key2ConfFile,
 
 		ConfTaskHeaders: cf.ConfTaskHeaders,
 		ConfTaskTimeout: time.Duration(cf.ConfTaskTimeoutMs) * time.Millisecond,
+
+		ConfTaskWatchTimeout: time.Duration(cf.ConfTaskWatchTimeoutMs) * time.Millisecond,
+		ConfAPIMethod:        cf.ConfAPIMethod,
+		MaxConfResponseBytes: cf.MaxConfResponseBytes,
+		ReloaderFiles:        rcf.confFileNames(),
+
+		HTTPRetry: newRetryConfig(cf.HTTPRetryAttempts, cf.HTTPRetryBackoffMinMs, cf.HTTPRetryBackoffMaxMs),
+		Breaker: BreakerConfig{
+			FailureThreshold: cf.BreakerFailureThreshold,
+			Cooldown:         time.Duration(cf.BreakerCooldownMs) * time.Millisecond,
+		},
+		HTTPClient: newHTTPClientConfig(cf.HTTPClientConfigFile),
 	}
 }
 
 type ExtraFileTaskConfig struct {
 	NormalFileTaskConfig
 
-	ExtraFileServer      string
+	ExtraFileServer      EndpointConfig
 	ExtraFileTaskHeaders map[string]string
 	ExtraFileTaskTimeout time.Duration
+	// ExtraFileTaskConcurrency is the max count of extra files downloading at the same time
+	ExtraFileTaskConcurrency int
+	// MaxExtraFileBytes is the max size of an extra file, 0 means no limit
+	MaxExtraFileBytes int64
+	// ExtraFileStreamToDisk writes extra files to disk while downloading instead of keeping them in memory
+	ExtraFileStreamToDisk bool
 
 	// see https://goessner.net/articles/JsonPath/
 	JSONPaths []jp.Expr `json:"-"`
 }
 
+// RetryConfig decides how a http request is retried
+type RetryConfig struct {
+	// Attempts is the max count of attempts, including the first one
+	Attempts int
+	Backoff  xbackoff.Backoff
+}
+
+func newRetryConfig(attempts, minMs, maxMs int) RetryConfig {
+	return RetryConfig{
+		Attempts: attempts,
+		Backoff: xbackoff.Backoff{
+			Min:        time.Duration(minMs) * time.Millisecond,
+			Max:        time.Duration(maxMs) * time.Millisecond,
+			Multiplier: 2,
+			Jitter:     0.2,
+		},
+	}
+}
+
+// HTTPClientConfig is the options of http client connecting to a server.
+// It is comparable, requests with the same config share a transport.
+type HTTPClientConfig struct {
+	TLS   TLSConfig
+	Proxy ProxyConfig
+	// UnixSocket is the path of Unix domain socket all requests are sent to, proxy is not used then
+	UnixSocket string
+
+	// MaxIdleConnsPerHost is the max count of idle connections kept for reuse per server
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is the time an idle connection is kept
+	IdleConnTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes
+	KeepAlive time.Duration
+	// DisableHTTP2 disables HTTP/2, which is used if server supports it by default
+	DisableHTTP2 bool
+	// DisableCompression stops requesting gzip compressed responses
+	DisableCompression bool
+}
+
+// ProxyConfig is the proxy of http client, proxies of environment are used if neither proxy is set
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy is the hosts requested directly, in the format of NO_PROXY
+	NoProxy string
+}
+
+// TLSConfig is the TLS options of http client, zero value means go defaults
+type TLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// MinVersion is 1.0, 1.1, 1.2 or 1.3
+	MinVersion string
+}
+
+func newHTTPClientConfig(cf HTTPClientConfigFile) HTTPClientConfig {
+	return HTTPClientConfig{
+		TLS: TLSConfig{
+			CAFile:     cf.TLSCAFile,
+			CertFile:   cf.TLSCertFile,
+			KeyFile:    cf.TLSKeyFile,
+			ServerName: cf.TLSServerName,
+			MinVersion: cf.TLSMinVersion,
+		},
+		Proxy: ProxyConfig{
+			HTTPProxy:  cf.HTTPProxy,
+			HTTPSProxy: cf.HTTPSProxy,
+			NoProxy:    cf.NoProxy,
+		},
+		UnixSocket: cf.UnixSocket,
+
+		MaxIdleConnsPerHost: cf.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(cf.IdleConnTimeoutMs) * time.Millisecond,
+		KeepAlive:           time.Duration(cf.KeepAliveMs) * time.Millisecond,
+		DisableHTTP2:        boolValue(cf.DisableHTTP2),
+		DisableCompression:  boolValue(cf.DisableCompression),
+	}
+}
+
+// BreakerConfig is the config of circuit breaker of a ConfAPI
+type BreakerConfig struct {
+	// FailureThreshold is the count of consecutive failures to open breaker, 0 means disabled
+	FailureThreshold int
+	// Cooldown is the time breaker keeps open before a probe call is let through
+	Cooldown time.Duration
+}
+
+type ProbeConfig struct {
+	// Concurrency is the max count of tasks running at the same time
+	Concurrency int
+	// Timeout is the deadline of all tasks in a cycle, 0 means no deadline
+	Timeout time.Duration
+}
+
 type TriggerConfig struct {
 	BFEReloadAPI     string
 	BFEReloadTimeout time.Duration
@@ -122,10 +386,14 @@ func newExtraFileTaskConfig(cf ExtraFileTaskConfigFile, rcf ReloaderConfigFile)
 	return &ExtraFileTaskConfig{
 		NormalFileTaskConfig: *newNormalFileTaskConfig(cf.NormalFileTaskConfigFile, rcf),
 
-		ExtraFileServer:      cf.ExtraFileServer,
+		ExtraFileServer:      newEndpointConfig(cf.ExtraFileServer, cf.EndpointStrategy, cf.EndpointCooldownMs),
 		ExtraFileTaskHeaders: cf.ExtraFileTaskHeaders,
 		ExtraFileTaskTimeout: time.Duration(cf.ExtraFileTaskTimeoutMs) * time.Millisecond,
 
+		ExtraFileTaskConcurrency: cf.ExtraFileTaskConcurrency,
+		MaxExtraFileBytes:        cf.MaxExtraFileBytes,
+		ExtraFileStreamToDisk:    *cf.ExtraFileStreamToDisk,
+
 		JSONPaths: patterns,
 	}, nil
 }
@@ -141,7 +409,26 @@ func newReloaderConfig(rcf *ReloaderConfigFile, basic BasicFile) (*ReloaderConfi
 			BFEReloadTimeout: time.Duration(rcf.BFEReloadTimeoutMs) * time.Millisecond,
 			ConfDir:          rcf.ConfDir,
 		},
+		Probe: ProbeConfig{
+			Concurrency: rcf.ProbeConcurrency,
+			Timeout:     time.Duration(rcf.ProbeTimeoutMs) * time.Millisecond,
+		},
 		CopyFiles: rcf.CopyFiles,
+		ConfFiles: rcf.confFileNames(),
+
+		RetainVersionCount: rcf.RetainVersionCount,
+		RetainVersionAge:   time.Duration(rcf.RetainVersionAgeMs) * time.Millisecond,
+
+		RetryBackoff: xbackoff.Backoff{
+			Min:        time.Duration(rcf.RetryBackoffMinMs) * time.Millisecond,
+			Max:        time.Duration(rcf.RetryBackoffMaxMs) * time.Millisecond,
+			Multiplier: rcf.RetryBackoffMultiplier,
+			Jitter:     *rcf.RetryBackoffJitter,
+		},
+		TriggerRetryDelay: time.Duration(rcf.TriggerRetryDelayMs) * time.Millisecond,
+
+		FreezeWindows: append(append([]FreezeWindow{}, basic.FreezeWindows...), rcf.FreezeWindows...),
+		FreezeFiles:   []string{basic.freezeFile(), rcf.ConfDir + ".freeze"},
 	}
 
 	for _, task := range rcf.NormalFileTasks {
@@ -171,10 +458,50 @@ func Init(configFile string) (*Config, error) {
 			BFEConfDir:         "/home/work/bfe/conf",
 
 			ConfTaskTimeoutMs: 2500,
+			ConfAPIMethod:     "GET",
+
+			HTTPRetryAttempts:     3,
+			HTTPRetryBackoffMinMs: 100,
+			HTTPRetryBackoffMaxMs: 2000,
 
-			ExtraFileTaskTimeoutMs: 2500,
+			BreakerFailureThreshold: 5,
+			BreakerCooldownMs:       30000,
+
+			EndpointStrategy:   "failover",
+			EndpointCooldownMs: 10000,
+
+			ExtraFileTaskTimeoutMs:   2500,
+			ExtraFileTaskConcurrency: 4,
+
+			MaxConfResponseBytes: 64 << 20,
+			MaxExtraFileBytes:    256 << 20,
 
 			ReloadIntervalMs: 10000,
+
+			ProbeConcurrency: 4,
+
+			RetainVersionCount: 5,
+
+			RetryBackoffMaxMs:      300000,
+			RetryBackoffMultiplier: 2,
+			RetryBackoffJitter:     0.2,
+			TriggerRetryDelayMs:    1000,
+
+			StopTimeoutMs: 5000,
+
+			PushReconnectMinMs: 1000,
+			PushReconnectMaxMs: 60000,
+
+			RequestIDHeader:  "X-Request-Id",
+			HostnameHeader:   "X-Conf-Agent-Hostname",
+			InstanceIDHeader: "X-Conf-Agent-Instance-Id",
+			ReloaderHeader:   "X-Conf-Agent-Reloader",
+
+			HTTPClientConfigFile: HTTPClientConfigFile{
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeoutMs:   90000,
+				KeepAliveMs:         30000,
+			},
 		},
 	}
 
@@ -182,6 +509,10 @@ func Init(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := checkFreezeWindows(config.Basic.FreezeWindows); err != nil {
+		return nil, err
+	}
+
 	for name, reloader := range config.Reloaders {
 		reloader.name = name
 		if err := reloader.merge(&config.Basic); err != nil {
@@ -207,6 +538,7 @@ func Init(configFile string) (*Config, error) {
 	})
 
 	return &Config{
+		Agent:     newAgentConfig(config.Basic),
 		Reloaders: reloaders,
 		Logger:    &config.Logger,
 	}, nil
@@ -17,6 +17,8 @@ package config
 import (
 	"fmt"
 	"path"
+	"sort"
+	"time"
 )
 
 type BasicFile struct {
@@ -32,21 +34,207 @@ type BasicFile struct {
 	// BFEReloadTimeoutMs is the timeout of reload BFE request
 	BFEReloadTimeoutMs int `validate:"min=1"`
 
-	// ConfServer is api server address
-	ConfServer string `validate:"min=1"`
+	// ConfServer is api server address, a string or a list of endpoints
+	ConfServer Endpoints `validate:"min=1,dive,min=1"`
 	// ConfTaskHeaders will be carry to api server
 	// Authorization should be set
 	ConfTaskHeaders map[string]string
 	// ConfTaskTimeoutMs is the timeout of conf prober request
 	ConfTaskTimeoutMs int `validate:"min=1"`
-
-	// ExtraFileSever is Extra File address
-	ExtraFileServer string `validate:"min=1"`
+	// ConfTaskWatchTimeoutMs is the max time conf server holds a watch(long-poll) request, 0 means watch is disabled
+	ConfTaskWatchTimeoutMs int `validate:"min=0"`
+	// ConfAPIMethod is GET or POST. For POST, the body tells conf server the cluster, hostname
+	// and current version of every conf file of the reloader, so server can reply a precise delta
+	ConfAPIMethod string `validate:"oneof=GET POST"`
+	// MaxConfResponseBytes is the max size of conf API response, 0 means no limit
+	MaxConfResponseBytes int64 `validate:"min=0"`
+
+	// HTTPRetryAttempts is the max count of attempts of a conf or extra file request, 1 means no retry
+	// network errors and 5xx/429 responses are retried
+	HTTPRetryAttempts int `validate:"min=1"`
+	// HTTPRetryBackoffMinMs and HTTPRetryBackoffMaxMs limit the backoff between attempts
+	HTTPRetryBackoffMinMs int `validate:"min=1"`
+	HTTPRetryBackoffMaxMs int `validate:"min=1,gtefield=HTTPRetryBackoffMinMs"`
+
+	// BreakerFailureThreshold opens circuit breaker of a ConfAPI after consecutive failures, 0 means disabled
+	// calls are short-circuited while open, a probe call is let through after BreakerCooldownMs
+	BreakerFailureThreshold int `validate:"min=0"`
+	BreakerCooldownMs       int `validate:"min=1"`
+
+	// ExtraFileSever is Extra File address, a string or a list of endpoints
+	ExtraFileServer Endpoints `validate:"min=1,dive,min=1"`
+
+	// EndpointStrategy decides the order endpoints of ConfServer/ExtraFileServer are tried, failover or round_robin
+	EndpointStrategy string `validate:"oneof=failover round_robin"`
+	// EndpointCooldownMs is the time an endpoint is unhealthy after failure, 0 means never unhealthy
+	EndpointCooldownMs int `validate:"min=0"`
 	// ExtraFileTaskHeaders will be carry to extra file server
 	// Authorization should be set
 	ExtraFileTaskHeaders map[string]string
 	// ExtraFileTaskTimeoutMs is the timeout of extra file download request
 	ExtraFileTaskTimeoutMs int `validate:"min=1"`
+	// ExtraFileTaskConcurrency is the max count of extra files downloading at the same time
+	ExtraFileTaskConcurrency int `validate:"min=1"`
+	// MaxExtraFileBytes is the max size of an extra file, 0 means no limit
+	MaxExtraFileBytes int64 `validate:"min=0"`
+	// ExtraFileStreamToDisk writes extra files to disk while downloading instead of keeping them in memory,
+	// they are staged in {ConfDir}.extra_files and hard linked to version directory
+	ExtraFileStreamToDisk bool
+
+	// RetryBackoffMinMs is the delay after a failed reload cycle, instead of ReloadIntervalMs,
+	// it grows by RetryBackoffMultiplier after each consecutive failure, up to RetryBackoffMaxMs.
+	// 0 means ReloadIntervalMs of each reloader
+	RetryBackoffMinMs      int     `validate:"min=0"`
+	RetryBackoffMaxMs      int     `validate:"min=1,gtefield=RetryBackoffMinMs"`
+	RetryBackoffMultiplier float64 `validate:"min=1"`
+	// RetryBackoffJitter randomizes the delay by ±RetryBackoffJitter, so agents don't retry in lockstep
+	RetryBackoffJitter float64 `validate:"min=0,max=1"`
+	// TriggerRetryDelayMs replaces RetryBackoffMinMs when only bfe reload fails, conf files have been stored then
+	TriggerRetryDelayMs int `validate:"min=1"`
+
+	// StopTimeoutMs is the max time to wait for in-progress reload cycles when agent stop
+	StopTimeoutMs int `validate:"min=1"`
+
+	// ProbeConcurrency is the max count of tasks of a reloader running at the same time
+	ProbeConcurrency int `validate:"min=1"`
+	// ProbeTimeoutMs is the deadline of all tasks of a reloader in a cycle, 0 means no deadline
+	ProbeTimeoutMs int `validate:"min=0"`
+
+	// RetainVersionCount is the count of newest {ConfDir}_{version} directories kept, including the current one,
+	// they are the versions reloader can roll back to
+	RetainVersionCount int `validate:"min=1"`
+	// RetainVersionAgeMs keeps {ConfDir}_{version} directories modified within it, 0 means disabled
+	RetainVersionAgeMs int `validate:"min=0"`
+
+	// FreezeWindows is the time windows in which all reloaders stop applying updates
+	FreezeWindows []FreezeWindow
+	// FreezeFile is the marker file, all reloaders stop applying updates if it exists
+	// optional, default is {BFEConfDir}/conf-agent.freeze
+	FreezeFile string
+
+	// PushAPI is the SSE API of conf server which announces reloaders having newer version
+	// optional, push is disabled if not set
+	PushAPI string
+	// PushReconnectMinMs and PushReconnectMaxMs limit the backoff of reconnecting push API
+	PushReconnectMinMs int `validate:"min=1"`
+	PushReconnectMaxMs int `validate:"min=1,gtefield=PushReconnectMinMs"`
+
+	// AdminAddr is the listen address of admin server, such as 127.0.0.1:8422
+	// optional, admin server is disabled if not set
+	AdminAddr string
+	// AdminToken is required in X-Admin-Token header of write requests of admin server
+	// optional, write requests are only accepted from loopback address if not set
+	AdminToken string
+
+	// RequestIDHeader carries LogID of reload cycle in every request, so logs of agent and server can be correlated
+	RequestIDHeader string
+	// HostnameHeader, InstanceIDHeader and ReloaderHeader carry identity of agent in every request
+	// optional, header is not sent if its name is empty
+	HostnameHeader   string
+	InstanceIDHeader string
+	ReloaderHeader   string
+	// Hostname overrides hostname of os in HostnameHeader and POST body of conf API
+	Hostname string
+	// InstanceID identifies the agent, such as when multiple agents run on a host
+	// optional, InstanceIDHeader is not sent if not set
+	InstanceID string
+
+	// HTTPClientConfigFile is the http client options of ConfServer and ExtraFileServer
+	HTTPClientConfigFile
+}
+
+// HTTPClientConfigFile is the options of http client connecting to ConfServer/ExtraFileServer
+type HTTPClientConfigFile struct {
+	// TLSCAFile is the PEM file of CA certificates to verify server, system CAs are used if not set
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are the PEM files of client certificate, both or neither should be set
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSServerName overrides the server name used to verify server certificate
+	TLSServerName string
+	// TLSMinVersion is the min TLS version, 1.0, 1.1, 1.2 or 1.3
+	TLSMinVersion string `validate:"omitempty,oneof=1.0 1.1 1.2 1.3"`
+
+	// HTTPProxy and HTTPSProxy are the proxies of http and https requests, such as http://10.0.0.1:3128
+	// environment (HTTP_PROXY/HTTPS_PROXY/NO_PROXY) is used for any of HTTPProxy, HTTPSProxy and NoProxy not set
+	HTTPProxy  string
+	HTTPSProxy string
+	// NoProxy is the comma separated hosts requested directly, in the format of NO_PROXY
+	NoProxy string
+	// UnixSocket is the path of Unix domain socket, such as a local forwarder, all requests are sent to
+	UnixSocket string
+
+	// MaxIdleConnsPerHost is the max count of idle connections kept for reuse per server
+	// connections are shared by tasks with the same http client options
+	MaxIdleConnsPerHost int `validate:"min=1"`
+	// IdleConnTimeoutMs is the time an idle connection is kept
+	IdleConnTimeoutMs int `validate:"min=1"`
+	// KeepAliveMs is the interval of TCP keep-alive probes
+	KeepAliveMs int `validate:"min=1"`
+	// DisableHTTP2 disables HTTP/2, which is used if server supports it by default
+	// it's a pointer so a task can set false against BasicFile, nil means inherit
+	DisableHTTP2 *bool
+	// DisableCompression stops requesting gzip compressed responses(Accept-Encoding: gzip)
+	// it's a pointer so a task can set false against BasicFile, nil means inherit
+	DisableCompression *bool
+}
+
+func (cf *HTTPClientConfigFile) merge(basic *HTTPClientConfigFile) {
+	if cf.TLSCAFile == "" {
+		cf.TLSCAFile = basic.TLSCAFile
+	}
+
+	if cf.TLSCertFile == "" {
+		cf.TLSCertFile = basic.TLSCertFile
+	}
+
+	if cf.TLSKeyFile == "" {
+		cf.TLSKeyFile = basic.TLSKeyFile
+	}
+
+	if cf.TLSServerName == "" {
+		cf.TLSServerName = basic.TLSServerName
+	}
+
+	if cf.TLSMinVersion == "" {
+		cf.TLSMinVersion = basic.TLSMinVersion
+	}
+
+	if cf.HTTPProxy == "" {
+		cf.HTTPProxy = basic.HTTPProxy
+	}
+
+	if cf.HTTPSProxy == "" {
+		cf.HTTPSProxy = basic.HTTPSProxy
+	}
+
+	if cf.NoProxy == "" {
+		cf.NoProxy = basic.NoProxy
+	}
+
+	if cf.UnixSocket == "" {
+		cf.UnixSocket = basic.UnixSocket
+	}
+
+	if cf.MaxIdleConnsPerHost == 0 {
+		cf.MaxIdleConnsPerHost = basic.MaxIdleConnsPerHost
+	}
+
+	if cf.IdleConnTimeoutMs == 0 {
+		cf.IdleConnTimeoutMs = basic.IdleConnTimeoutMs
+	}
+
+	if cf.KeepAliveMs == 0 {
+		cf.KeepAliveMs = basic.KeepAliveMs
+	}
+
+	if cf.DisableHTTP2 == nil {
+		cf.DisableHTTP2 = basic.DisableHTTP2
+	}
+
+	if cf.DisableCompression == nil {
+		cf.DisableCompression = basic.DisableCompression
+	}
 }
 
 type ReloaderConfigFile struct {
@@ -63,6 +251,20 @@ type ReloaderConfigFile struct {
 	// optional, inherit BasicConfig if not set
 	BFEReloadTimeoutMs int `validate:"min=1"`
 	ReloadIntervalMs   int `validate:"min=1"`
+	ProbeConcurrency   int `validate:"min=1"`
+	ProbeTimeoutMs     int `validate:"min=0"`
+	RetainVersionCount int `validate:"min=1"`
+	RetainVersionAgeMs int `validate:"min=0"`
+
+	RetryBackoffMinMs      int     `validate:"min=1"`
+	RetryBackoffMaxMs      int     `validate:"min=1,gtefield=RetryBackoffMinMs"`
+	RetryBackoffMultiplier float64 `validate:"min=1"`
+	// RetryBackoffJitter is a pointer as 0 disables jitter, nil means inherit BasicFile
+	RetryBackoffJitter  *float64 `validate:"omitempty,min=0,max=1"`
+	TriggerRetryDelayMs int      `validate:"min=1"`
+
+	// FreezeWindows is the time windows in which reloader stops applying updates, besides BasicFile.FreezeWindows
+	FreezeWindows []FreezeWindow
 
 	// CopyFiles is the file/directory which will be copy from default conf dir to newer version conf dir
 	// many conf can't fetch from conf file, newer version conf dir show inherit them so bfe can startup aftert stop
@@ -87,16 +289,42 @@ type NormalFileTaskConfigFile struct {
 	ConfFileName string `validate:"required"`
 
 	// optional
-	ConfServer        string `validate:"min=1"`
+	ConfServer        Endpoints `validate:"min=1,dive,min=1"`
 	ConfTaskHeaders   map[string]string
 	ConfTaskTimeoutMs int `validate:"min=1"`
+
+	EndpointStrategy   string `validate:"oneof=failover round_robin"`
+	EndpointCooldownMs int    `validate:"min=0"`
+
+	ConfTaskWatchTimeoutMs int    `validate:"min=0"`
+	ConfAPIMethod          string `validate:"oneof=GET POST"`
+	MaxConfResponseBytes   int64  `validate:"min=0"`
+
+	HTTPRetryAttempts     int `validate:"min=1"`
+	HTTPRetryBackoffMinMs int `validate:"min=1"`
+	HTTPRetryBackoffMaxMs int `validate:"min=1,gtefield=HTTPRetryBackoffMinMs"`
+
+	BreakerFailureThreshold int `validate:"min=0"`
+	BreakerCooldownMs       int `validate:"min=1"`
+
+	HTTPClientConfigFile
 }
 
 func (tf *NormalFileTaskConfigFile) merge(basic *BasicFile) {
-	if tf.ConfServer == "" {
+	tf.HTTPClientConfigFile.merge(&basic.HTTPClientConfigFile)
+
+	if len(tf.ConfServer) == 0 {
 		tf.ConfServer = basic.ConfServer
 	}
 
+	if tf.EndpointStrategy == "" {
+		tf.EndpointStrategy = basic.EndpointStrategy
+	}
+
+	if tf.EndpointCooldownMs == 0 {
+		tf.EndpointCooldownMs = basic.EndpointCooldownMs
+	}
+
 	if tf.ConfTaskHeaders == nil {
 		tf.ConfTaskHeaders = basic.ConfTaskHeaders
 	}
@@ -104,6 +332,38 @@ func (tf *NormalFileTaskConfigFile) merge(basic *BasicFile) {
 	if tf.ConfTaskTimeoutMs == 0 {
 		tf.ConfTaskTimeoutMs = basic.ConfTaskTimeoutMs
 	}
+
+	if tf.ConfTaskWatchTimeoutMs == 0 {
+		tf.ConfTaskWatchTimeoutMs = basic.ConfTaskWatchTimeoutMs
+	}
+
+	if tf.ConfAPIMethod == "" {
+		tf.ConfAPIMethod = basic.ConfAPIMethod
+	}
+
+	if tf.MaxConfResponseBytes == 0 {
+		tf.MaxConfResponseBytes = basic.MaxConfResponseBytes
+	}
+
+	if tf.HTTPRetryAttempts == 0 {
+		tf.HTTPRetryAttempts = basic.HTTPRetryAttempts
+	}
+
+	if tf.HTTPRetryBackoffMinMs == 0 {
+		tf.HTTPRetryBackoffMinMs = basic.HTTPRetryBackoffMinMs
+	}
+
+	if tf.HTTPRetryBackoffMaxMs == 0 {
+		tf.HTTPRetryBackoffMaxMs = basic.HTTPRetryBackoffMaxMs
+	}
+
+	if tf.BreakerFailureThreshold == 0 {
+		tf.BreakerFailureThreshold = basic.BreakerFailureThreshold
+	}
+
+	if tf.BreakerCooldownMs == 0 {
+		tf.BreakerCooldownMs = basic.BreakerCooldownMs
+	}
 }
 
 type ExtraFileTaskConfigFile struct {
@@ -115,15 +375,20 @@ type ExtraFileTaskConfigFile struct {
 	ExtraFileJSONPaths []string
 
 	// optional
-	ExtraFileServer        string `validate:"min=1"`
+	ExtraFileServer        Endpoints `validate:"min=1,dive,min=1"`
 	ExtraFileTaskHeaders   map[string]string
 	ExtraFileTaskTimeoutMs int `validate:"min=1"`
+
+	ExtraFileTaskConcurrency int   `validate:"min=1"`
+	MaxExtraFileBytes        int64 `validate:"min=0"`
+	// ExtraFileStreamToDisk is a pointer so a task can set false against BasicFile, nil means inherit
+	ExtraFileStreamToDisk *bool
 }
 
 func (tf *ExtraFileTaskConfigFile) merge(basic *BasicFile) {
 	tf.NormalFileTaskConfigFile.merge(basic)
 
-	if tf.ExtraFileServer == "" {
+	if len(tf.ExtraFileServer) == 0 {
 		tf.ExtraFileServer = basic.ExtraFileServer
 	}
 
@@ -134,6 +399,19 @@ func (tf *ExtraFileTaskConfigFile) merge(basic *BasicFile) {
 	if tf.ExtraFileTaskTimeoutMs == 0 {
 		tf.ExtraFileTaskTimeoutMs = basic.ExtraFileTaskTimeoutMs
 	}
+
+	if tf.ExtraFileTaskConcurrency == 0 {
+		tf.ExtraFileTaskConcurrency = basic.ExtraFileTaskConcurrency
+	}
+
+	if tf.MaxExtraFileBytes == 0 {
+		tf.MaxExtraFileBytes = basic.MaxExtraFileBytes
+	}
+
+	if tf.ExtraFileStreamToDisk == nil {
+		streamToDisk := basic.ExtraFileStreamToDisk
+		tf.ExtraFileStreamToDisk = &streamToDisk
+	}
 }
 
 type MultiJSONKeyFileTaskConfigFile struct {
@@ -143,16 +421,42 @@ type MultiJSONKeyFileTaskConfigFile struct {
 	Key2ConfFile map[string]string
 
 	// optional
-	ConfServer        string `validate:"min=1"`
+	ConfServer        Endpoints `validate:"min=1,dive,min=1"`
 	ConfTaskHeaders   map[string]string
 	ConfTaskTimeoutMs int `validate:"min=1"`
+
+	EndpointStrategy   string `validate:"oneof=failover round_robin"`
+	EndpointCooldownMs int    `validate:"min=0"`
+
+	ConfTaskWatchTimeoutMs int    `validate:"min=0"`
+	ConfAPIMethod          string `validate:"oneof=GET POST"`
+	MaxConfResponseBytes   int64  `validate:"min=0"`
+
+	HTTPRetryAttempts     int `validate:"min=1"`
+	HTTPRetryBackoffMinMs int `validate:"min=1"`
+	HTTPRetryBackoffMaxMs int `validate:"min=1,gtefield=HTTPRetryBackoffMinMs"`
+
+	BreakerFailureThreshold int `validate:"min=0"`
+	BreakerCooldownMs       int `validate:"min=1"`
+
+	HTTPClientConfigFile
 }
 
 func (tf *MultiJSONKeyFileTaskConfigFile) merge(basic *BasicFile) {
-	if tf.ConfServer == "" {
+	tf.HTTPClientConfigFile.merge(&basic.HTTPClientConfigFile)
+
+	if len(tf.ConfServer) == 0 {
 		tf.ConfServer = basic.ConfServer
 	}
 
+	if tf.EndpointStrategy == "" {
+		tf.EndpointStrategy = basic.EndpointStrategy
+	}
+
+	if tf.EndpointCooldownMs == 0 {
+		tf.EndpointCooldownMs = basic.EndpointCooldownMs
+	}
+
 	if tf.ConfTaskHeaders == nil {
 		tf.ConfTaskHeaders = basic.ConfTaskHeaders
 	}
@@ -160,6 +464,92 @@ func (tf *MultiJSONKeyFileTaskConfigFile) merge(basic *BasicFile) {
 	if tf.ConfTaskTimeoutMs == 0 {
 		tf.ConfTaskTimeoutMs = basic.ConfTaskTimeoutMs
 	}
+
+	if tf.ConfTaskWatchTimeoutMs == 0 {
+		tf.ConfTaskWatchTimeoutMs = basic.ConfTaskWatchTimeoutMs
+	}
+
+	if tf.ConfAPIMethod == "" {
+		tf.ConfAPIMethod = basic.ConfAPIMethod
+	}
+
+	if tf.MaxConfResponseBytes == 0 {
+		tf.MaxConfResponseBytes = basic.MaxConfResponseBytes
+	}
+
+	if tf.HTTPRetryAttempts == 0 {
+		tf.HTTPRetryAttempts = basic.HTTPRetryAttempts
+	}
+
+	if tf.HTTPRetryBackoffMinMs == 0 {
+		tf.HTTPRetryBackoffMinMs = basic.HTTPRetryBackoffMinMs
+	}
+
+	if tf.HTTPRetryBackoffMaxMs == 0 {
+		tf.HTTPRetryBackoffMaxMs = basic.HTTPRetryBackoffMaxMs
+	}
+
+	if tf.BreakerFailureThreshold == 0 {
+		tf.BreakerFailureThreshold = basic.BreakerFailureThreshold
+	}
+
+	if tf.BreakerCooldownMs == 0 {
+		tf.BreakerCooldownMs = basic.BreakerCooldownMs
+	}
+}
+
+// boolValue returns value of an optional bool, nil means false
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+// Endpoints is a list of server endpoints, a single string is accepted as well
+type Endpoints []string
+
+func (e *Endpoints) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*e = Endpoints{v}
+	case []interface{}:
+		endpoints := Endpoints{}
+		for _, item := range v {
+			endpoint, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("bad endpoint %v, want string", item)
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		*e = endpoints
+	default:
+		return fmt.Errorf("bad endpoints %v, want string or list of string", data)
+	}
+
+	return nil
+}
+
+// FreezeWindow is a time window [Start, End) in which updates are not applied
+// toml datetime is used, such as Start = 2021-12-31T00:00:00+08:00
+type FreezeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+func checkFreezeWindows(windows []FreezeWindow) error {
+	for _, window := range windows {
+		if !window.End.After(window.Start) {
+			return fmt.Errorf("bad FreezeWindow, End %s should be after Start %s", window.End, window.Start)
+		}
+	}
+
+	return nil
+}
+
+func (basic *BasicFile) freezeFile() string {
+	if basic.FreezeFile != "" {
+		return basic.FreezeFile
+	}
+
+	return path.Join(basic.BFEConfDir, "conf-agent.freeze")
 }
 
 type LoggerConfig struct {
@@ -179,6 +569,25 @@ type ConfigFile struct {
 	Reloaders map[string]*ReloaderConfigFile `validate:"required,dive,min=1"`
 }
 
+// confFileNames returns sorted names of conf files obtained by tasks
+func (reloader *ReloaderConfigFile) confFileNames() []string {
+	names := []string{}
+	for _, task := range reloader.NormalFileTasks {
+		names = append(names, task.ConfFileName)
+	}
+	for _, task := range reloader.MultiKeyFileTasks {
+		for _, name := range task.Key2ConfFile {
+			names = append(names, name)
+		}
+	}
+	for _, task := range reloader.ExtraFileTasks {
+		names = append(names, task.ConfFileName)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 func (reloader *ReloaderConfigFile) merge(basic *BasicFile) error {
 	name := reloader.name
 
@@ -186,6 +595,10 @@ func (reloader *ReloaderConfigFile) merge(basic *BasicFile) error {
 		reloader.BFECluster = basic.BFECluster
 	}
 
+	if err := checkFreezeWindows(reloader.FreezeWindows); err != nil {
+		return fmt.Errorf("reloader %s: %v", name, err)
+	}
+
 	taskCount := len(reloader.MultiKeyFileTasks) + len(reloader.NormalFileTasks) + len(reloader.ExtraFileTasks)
 	if taskCount == 0 {
 		return fmt.Errorf("reloader %s should has at least one task", name)
@@ -216,6 +629,42 @@ func (reloader *ReloaderConfigFile) merge(basic *BasicFile) error {
 	if reloader.ReloadIntervalMs == 0 {
 		reloader.ReloadIntervalMs = basic.ReloadIntervalMs
 	}
+	if reloader.ProbeConcurrency == 0 {
+		reloader.ProbeConcurrency = basic.ProbeConcurrency
+	}
+	if reloader.ProbeTimeoutMs == 0 {
+		reloader.ProbeTimeoutMs = basic.ProbeTimeoutMs
+	}
+	if reloader.RetainVersionCount == 0 {
+		reloader.RetainVersionCount = basic.RetainVersionCount
+	}
+	if reloader.RetainVersionAgeMs == 0 {
+		reloader.RetainVersionAgeMs = basic.RetainVersionAgeMs
+	}
+	// failed cycles retry no sooner than ReloadIntervalMs unless configured
+	if reloader.RetryBackoffMinMs == 0 {
+		reloader.RetryBackoffMinMs = basic.RetryBackoffMinMs
+	}
+	if reloader.RetryBackoffMinMs == 0 {
+		reloader.RetryBackoffMinMs = reloader.ReloadIntervalMs
+	}
+	if reloader.RetryBackoffMaxMs == 0 {
+		reloader.RetryBackoffMaxMs = basic.RetryBackoffMaxMs
+		// inherited max doesn't conflict with a long ReloadIntervalMs
+		if reloader.RetryBackoffMaxMs < reloader.RetryBackoffMinMs {
+			reloader.RetryBackoffMaxMs = reloader.RetryBackoffMinMs
+		}
+	}
+	if reloader.RetryBackoffMultiplier == 0 {
+		reloader.RetryBackoffMultiplier = basic.RetryBackoffMultiplier
+	}
+	if reloader.RetryBackoffJitter == nil {
+		jitter := basic.RetryBackoffJitter
+		reloader.RetryBackoffJitter = &jitter
+	}
+	if reloader.TriggerRetryDelayMs == 0 {
+		reloader.TriggerRetryDelayMs = basic.TriggerRetryDelayMs
+	}
 
 	return nil
 }
@@ -0,0 +1,327 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/xbackoff"
+)
+
+const testLoggerConf = `
+[Logger]
+LogDir      = "./log/"
+LogName     = "conf_agent"
+LogLevel    = "INFO"
+RotateWhen  = "MIDNIGHT"
+BackupCount = 2
+Format      = "[%D %T] [%L] [%S] %M"
+`
+
+// initTestConfig writes basic and reloaders to a config file, then loads it by Init
+func initTestConfig(t *testing.T, basic, reloaders string) (*Config, error) {
+	t.Helper()
+
+	content := testLoggerConf + `
+[Basic]
+BFECluster      = "test"
+BFEConfDir      = "/home/work/bfe/conf"
+ExtraFileServer = "http://extra/"
+` + basic + "\n" + reloaders
+
+	path := filepath.Join(t.TempDir(), "conf-agent.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return Init(path)
+}
+
+func TestInitEndpoints(t *testing.T) {
+	reloaders := `
+[Reloaders.test]
+[[Reloaders.test.NormalFileTasks]]
+ConfAPI      = "/a"
+ConfFileName = "a.data"
+[[Reloaders.test.NormalFileTasks]]
+ConfAPI            = "/b"
+ConfFileName       = "b.data"
+ConfServer         = ["http://b1", "http://b2"]
+EndpointStrategy   = "failover"
+EndpointCooldownMs = 1000
+`
+
+	tests := []struct {
+		name    string
+		basic   string
+		wantErr bool
+
+		// want of task a.data, which inherits Basic
+		want EndpointConfig
+	}{
+		{
+			name:  "case_single_string",
+			basic: `ConfServer = "http://a"`,
+			want: EndpointConfig{
+				Endpoints: []string{"http://a"},
+				Strategy:  "failover",
+				Cooldown:  10 * time.Second,
+			},
+		},
+		{
+			name: "case_list",
+			basic: `ConfServer = ["http://a1", "http://a2"]
+EndpointStrategy   = "round_robin"
+EndpointCooldownMs = 0`,
+			want: EndpointConfig{
+				Endpoints: []string{"http://a1", "http://a2"},
+				Strategy:  "round_robin",
+				Cooldown:  0,
+			},
+		},
+		{
+			name:    "case_not_string",
+			basic:   `ConfServer = 8183`,
+			wantErr: true,
+		},
+		{
+			name:    "case_not_string_in_list",
+			basic:   `ConfServer = ["http://a", 8183]`,
+			wantErr: true,
+		},
+		{
+			name:    "case_empty_list",
+			basic:   `ConfServer = []`,
+			wantErr: true,
+		},
+		{
+			name: "case_invalid_strategy",
+			basic: `ConfServer = "http://a"
+EndpointStrategy = "random"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := initTestConfig(t, tt.basic, reloaders)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			tasks := c.Reloaders[0].NormalFileTasks
+			if got := tasks[0].ConfServer; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("inherited ConfServer = %+v, want %+v", got, tt.want)
+			}
+
+			// task b.data overrides Basic
+			want := EndpointConfig{
+				Endpoints: []string{"http://b1", "http://b2"},
+				Strategy:  "failover",
+				Cooldown:  time.Second,
+			}
+			if got := tasks[1].ConfServer; !reflect.DeepEqual(got, want) {
+				t.Errorf("overridden ConfServer = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestInitRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		basic    string
+		reloader string
+		wantErr  bool
+
+		want xbackoff.Backoff
+	}{
+		{
+			name: "case_default",
+			want: xbackoff.Backoff{
+				Min:        10 * time.Second,
+				Max:        300 * time.Second,
+				Multiplier: 2,
+				Jitter:     0.2,
+			},
+		},
+		{
+			name:     "case_min_is_reload_interval",
+			reloader: `ReloadIntervalMs = 3000`,
+			want: xbackoff.Backoff{
+				Min:        3 * time.Second,
+				Max:        300 * time.Second,
+				Multiplier: 2,
+				Jitter:     0.2,
+			},
+		},
+		{
+			name:     "case_inherited_max_raised_to_min",
+			reloader: `ReloadIntervalMs = 600000`,
+			want: xbackoff.Backoff{
+				Min:        600 * time.Second,
+				Max:        600 * time.Second,
+				Multiplier: 2,
+				Jitter:     0.2,
+			},
+		},
+		{
+			name: "case_basic_min",
+			basic: `RetryBackoffMinMs  = 2000
+RetryBackoffJitter = 0.5`,
+			reloader: `ReloadIntervalMs = 600000`,
+			want: xbackoff.Backoff{
+				Min:        2 * time.Second,
+				Max:        300 * time.Second,
+				Multiplier: 2,
+				Jitter:     0.5,
+			},
+		},
+		{
+			name:  "case_zero_jitter_of_reloader",
+			basic: `RetryBackoffJitter = 0.5`,
+			reloader: `RetryBackoffMinMs  = 1000
+RetryBackoffMaxMs  = 5000
+RetryBackoffJitter = 0.0`,
+			want: xbackoff.Backoff{
+				Min:        time.Second,
+				Max:        5 * time.Second,
+				Multiplier: 2,
+				Jitter:     0,
+			},
+		},
+		{
+			name: "case_reloader_max_less_than_min",
+			reloader: `RetryBackoffMinMs = 5000
+RetryBackoffMaxMs = 1000`,
+			wantErr: true,
+		},
+		{
+			name:     "case_jitter_out_of_range",
+			reloader: `RetryBackoffJitter = 1.5`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaders := `
+[Reloaders.test]
+` + tt.reloader + `
+[[Reloaders.test.NormalFileTasks]]
+ConfAPI      = "/a"
+ConfFileName = "a.data"
+`
+			c, err := initTestConfig(t, `ConfServer = "http://a"
+`+tt.basic, reloaders)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if got := c.Reloaders[0].RetryBackoff; got != tt.want {
+				t.Errorf("RetryBackoff = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitOptionalBool(t *testing.T) {
+	tests := []struct {
+		name  string
+		basic string
+		task  string
+		get   func(c *Config) bool
+		want  bool
+	}{
+		{
+			name: "case_DisableHTTP2_default",
+			get:  func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].HTTPClient.DisableHTTP2 },
+			want: false,
+		},
+		{
+			name:  "case_DisableHTTP2_inherit",
+			basic: `DisableHTTP2 = true`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].HTTPClient.DisableHTTP2 },
+			want:  true,
+		},
+		{
+			name:  "case_DisableHTTP2_override",
+			basic: `DisableHTTP2 = true`,
+			task:  `DisableHTTP2 = false`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].HTTPClient.DisableHTTP2 },
+			want:  false,
+		},
+		{
+			name:  "case_DisableCompression_inherit",
+			basic: `DisableCompression = true`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].HTTPClient.DisableCompression },
+			want:  true,
+		},
+		{
+			name:  "case_DisableCompression_override",
+			basic: `DisableCompression = true`,
+			task:  `DisableCompression = false`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].HTTPClient.DisableCompression },
+			want:  false,
+		},
+		{
+			name:  "case_DisableCompression_push",
+			basic: `DisableCompression = true`,
+			get:   func(c *Config) bool { return c.Agent.Push.HTTPClient.DisableCompression },
+			want:  true,
+		},
+		{
+			name:  "case_ExtraFileStreamToDisk_inherit",
+			basic: `ExtraFileStreamToDisk = true`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].ExtraFileStreamToDisk },
+			want:  true,
+		},
+		{
+			name:  "case_ExtraFileStreamToDisk_override",
+			basic: `ExtraFileStreamToDisk = true`,
+			task:  `ExtraFileStreamToDisk = false`,
+			get:   func(c *Config) bool { return c.Reloaders[0].ExtraFileFileTasks[0].ExtraFileStreamToDisk },
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloaders := `
+[Reloaders.test]
+[[Reloaders.test.ExtraFileTasks]]
+ConfAPI            = "/a"
+ConfFileName       = "a.data"
+ExtraFileJSONPaths = ["$.Files[*]"]
+` + tt.task
+			c, err := initTestConfig(t, `ConfServer = "http://a"
+`+tt.basic, reloaders)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tt.get(c); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,9 @@ require (
 	github.com/leodido/go-urn v1.2.1 // indirect
 	github.com/ohler55/ojg v1.12.8
 	github.com/oliveagle/jsonpath v0.0.0-20180606110733-2e52cf6e6852
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/common v0.32.1
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 	gopkg.in/gcfg.v1 v1.2.3
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
@@ -18,7 +18,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/baidu/conf-agent/agent"
 	"github.com/baidu/conf-agent/config"
@@ -31,6 +33,8 @@ var (
 	showVer  *bool   = flag.Bool("v", false, "to show version")
 	confDir  *string = flag.String("c", "./conf/", "API configure dir")
 	confFile *string = flag.String("cf", "conf-agent.toml", "API configure file")
+	once     *bool   = flag.Bool("once", false, "to sync all reloaders once without triggering bfe reload, then exit")
+	dryRun   *bool   = flag.Bool("dry-run", false, "to print diff of newer conf files without storing or reloading, then exit")
 )
 
 func main() {
@@ -38,6 +42,7 @@ func main() {
 
 	if *help {
 		flag.PrintDefaults()
+		fmt.Println(commandUsage)
 		return
 	}
 	if *showVer {
@@ -47,6 +52,7 @@ func main() {
 
 	exit := func(err error) {
 		fmt.Println(err)
+		xlog.Close()
 		os.Exit(-1)
 	}
 
@@ -59,10 +65,71 @@ func main() {
 		exit(err)
 	}
 
-	agent, err := agent.New(conf.Reloaders)
+	agent, err := agent.New(conf)
 	if err != nil {
 		exit(err)
 	}
 
-	agent.Start()
+	if flag.NArg() > 0 {
+		if err := runCommand(agent, flag.Args(), os.Stdout); err != nil {
+			exit(err)
+		}
+
+		xlog.Close()
+		return
+	}
+
+	if *dryRun {
+		if err := agent.DryRun(os.Stdout); err != nil {
+			exit(err)
+		}
+
+		xlog.Close()
+		return
+	}
+
+	if *once {
+		if err := agent.RunOnce(); err != nil {
+			xlog.Default.Error(fmt.Sprintf("agent run once fail, err: %v", err))
+			exit(err)
+		}
+
+		xlog.Close()
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	startErr := make(chan error, 1)
+	go func() {
+		startErr <- agent.Start()
+	}()
+
+	// wait for stop signal, then wait for in-progress reload cycles
+	select {
+	case sig := <-signals:
+		xlog.Default.Info(fmt.Sprintf("receive signal %s, agent stopping", sig))
+
+		// a second signal forces exit without waiting
+		go func() {
+			sig := <-signals
+			xlog.Default.Error(fmt.Sprintf("receive signal %s again, agent exit without waiting", sig))
+			xlog.Close()
+			os.Exit(1)
+		}()
+	case err := <-startErr:
+		xlog.Default.Error(fmt.Sprintf("agent start fail, err: %v", err))
+		agent.Stop()
+		exit(err)
+	}
+
+	if err := agent.Stop(); err != nil {
+		xlog.Default.Error(fmt.Sprintf("agent stop fail, err: %v", err))
+		xlog.Close()
+		os.Exit(1)
+	}
+
+	xlog.Default.Info("agent stopped")
+	xlog.Close()
 }
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics implements labelled counters, gauges and histograms
+// which can be exported in prometheus text format
+package metrics
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefBuckets is the default buckets of histogram, in seconds
+var DefBuckets = prometheus.DefBuckets
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// Add adds delta to the counter, delta must not be negative
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	c.vec.WithLabelValues(labelValues...).Add(delta)
+}
+
+// Inc increases the counter by 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec *prometheus.GaugeVec
+}
+
+// Set sets the gauge to value
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.WithLabelValues(labelValues...).Set(value)
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// Observe adds a single observation to the histogram
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(value)
+}
+
+// Registry keeps metrics and exports them
+type Registry struct {
+	registry *prometheus.Registry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		registry: prometheus.NewRegistry(),
+	}
+}
+
+// Default is the registry used by package level constructors
+var Default = NewRegistry()
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{vec: prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)}
+	r.registry.MustRegister(c.vec)
+	return c
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labelNames)}
+	r.registry.MustRegister(g.vec)
+	return g
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	// prometheus requires buckets in increasing order
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labelNames)}
+	r.registry.MustRegister(h.vec)
+	return h
+}
+
+// NewCounterVec creates a CounterVec in Default registry
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labelNames...)
+}
+
+// NewGaugeVec creates a GaugeVec in Default registry
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labelNames...)
+}
+
+// NewHistogramVec creates a HistogramVec in Default registry
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labelNames...)
+}
+
+// Handler returns a http handler which exports metrics of r in prometheus format
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// Handler returns a http handler which exports metrics of Default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
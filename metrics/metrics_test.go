@@ -0,0 +1,61 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestRegistry_HandlerEscape(t *testing.T) {
+	r := NewRegistry()
+
+	values := []string{`C:\conf\"tls"`, "line1\nline2", "配置\t", ""}
+	counter := r.NewCounterVec("test_escape_total", "help with \\ and \n", "value")
+	for _, value := range values {
+		counter.Inc(value)
+	}
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	output := rec.Body.String()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("parse output error = %v, output:\n%s", err, output)
+	}
+
+	family, ok := families["test_escape_total"]
+	if !ok {
+		t.Fatalf("metric test_escape_total not found")
+	}
+	if family.GetHelp() != "help with \\ and \n" {
+		t.Errorf("help = %q", family.GetHelp())
+	}
+
+	got := map[string]bool{}
+	for _, m := range family.GetMetric() {
+		got[m.GetLabel()[0].GetValue()] = true
+	}
+	for _, value := range values {
+		if !got[value] {
+			t.Errorf("label value %q not found in output, got %v", value, got)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xbackoff
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential backoff delays with jitter
+type Backoff struct {
+	// Min is the delay after the first failure
+	Min time.Duration
+	// Max is the upper limit of delay
+	Max time.Duration
+	// Multiplier is the factor delay grows by after each failure, less than 1 means 1
+	Multiplier float64
+	// Jitter randomizes delay in [delay*(1-Jitter), delay*(1+Jitter)], so clients don't retry in lockstep
+	Jitter float64
+}
+
+// Delay returns the delay after n consecutive failures, n starts from 1
+func (b Backoff) Delay(n int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(b.Min)
+	for i := 1; i < n && delay < float64(b.Max); i++ {
+		delay *= multiplier
+	}
+
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	return time.Duration(delay)
+}
+
+// Sleep waits for d, returns false if ctx is done before that
+func Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
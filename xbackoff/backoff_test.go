@@ -0,0 +1,79 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xbackoff
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{
+		Min:        time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+	}
+
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{n: 1, want: time.Second},
+		{n: 2, want: 2 * time.Second},
+		{n: 4, want: 8 * time.Second},
+		{n: 5, want: 10 * time.Second},
+		{n: 100, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := b.Delay(tt.n); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := Backoff{
+		Min:        time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := b.Delay(2); got < time.Second || got > 3*time.Second {
+			t.Fatalf("Delay(2) = %v, want in [1s, 3s]", got)
+		}
+		if got := b.Delay(10); got < 5*time.Second || got > 10*time.Second {
+			t.Fatalf("Delay(10) = %v, want in [5s, 10s]", got)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !Sleep(context.Background(), time.Millisecond) {
+		t.Errorf("Sleep() = false, want true")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	begin := time.Now()
+	if Sleep(ctx, time.Hour) {
+		t.Errorf("Sleep() with done ctx = true, want false")
+	}
+	if cost := time.Since(begin); cost > time.Second {
+		t.Errorf("Sleep() with done ctx cost %s", cost)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DefaultContext is the count of context lines around changes, same as diff -u
+const DefaultContext = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type edit struct {
+	kind opKind
+	// line index in a for opEqual and opDelete, in b for opInsert
+	aIndex, bIndex int
+}
+
+// Unified returns the unified diff of a and b, it's empty if a equals b.
+// aName and bName are used as file names in header, such as a/xxx.data and b/xxx.data
+func Unified(aName, bName string, a, b []byte, context int) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	edits := myers(aLines, bLines)
+
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", aName, bName)
+
+	for _, h := range hunks(edits, context) {
+		aStart, aCount, bStart, bCount := h.ranges()
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", formatRange(aStart, aCount), formatRange(bStart, bCount))
+
+		for _, e := range h {
+			switch e.kind {
+			case opEqual:
+				writeLine(buf, " ", aLines[e.aIndex])
+			case opDelete:
+				writeLine(buf, "-", aLines[e.aIndex])
+			case opInsert:
+				writeLine(buf, "+", bLines[e.bIndex])
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+func writeLine(buf *strings.Builder, prefix, line string) {
+	buf.WriteString(prefix)
+	buf.WriteString(line)
+	if !strings.HasSuffix(line, "\n") {
+		buf.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// splitLines splits content into lines, each line keeps its line break
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// maxEditDistance limits the cost of myers, files with more changes are shown as replaced totally
+const maxEditDistance = 4096
+
+// myers computes the shortest edit script of a to b
+// see "An O(ND) Difference Algorithm and Its Variations", Eugene W. Myers
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] keeps v[-(d+1)...d+1] before round d, trace[d][k+d+1] is v[k]
+	trace := [][]int{}
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxEditDistance {
+			return replaceAll(n, m)
+		}
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// backtrack from (n, m) to (0, 0)
+	edits := []edit{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d+1] < v[k+1+d+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d+1]
+		prevY := prevX - prevK
+		if d == 0 {
+			prevX, prevY = 0, 0
+		}
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{kind: opEqual, aIndex: x, bIndex: y})
+		}
+
+		if d > 0 {
+			if x == prevX {
+				y--
+				edits = append(edits, edit{kind: opInsert, aIndex: x, bIndex: y})
+			} else {
+				x--
+				edits = append(edits, edit{kind: opDelete, aIndex: x, bIndex: y})
+			}
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// replaceAll returns edits which delete all lines of a then insert all lines of b
+func replaceAll(n, m int) []edit {
+	edits := []edit{}
+	for i := 0; i < n; i++ {
+		edits = append(edits, edit{kind: opDelete, aIndex: i})
+	}
+	for j := 0; j < m; j++ {
+		edits = append(edits, edit{kind: opInsert, aIndex: n, bIndex: j})
+	}
+	return edits
+}
+
+type hunk []edit
+
+// ranges returns start line (1-based) and line count of hunk in a and b
+func (h hunk) ranges() (aStart, aCount, bStart, bCount int) {
+	aStart, bStart = h[0].aIndex+1, h[0].bIndex+1
+	for _, e := range h {
+		switch e.kind {
+		case opEqual:
+			aCount++
+			bCount++
+		case opDelete:
+			aCount++
+		case opInsert:
+			bCount++
+		}
+	}
+
+	// empty range starts at the line before it
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+	return
+}
+
+func formatRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// hunks groups changes with context lines around them
+func hunks(edits []edit, context int) []hunk {
+	result := []hunk{}
+
+	var current hunk
+	lastChange := -1
+	for i, e := range edits {
+		if e.kind == opEqual {
+			continue
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		if current != nil && start <= lastChange+context+1 {
+			// close to last change, merge into current hunk
+			current = append(current, edits[lastChange+1:i+1]...)
+		} else {
+			if current != nil {
+				result = append(result, closeHunk(current, edits, lastChange, context))
+			}
+			current = append(hunk{}, edits[start:i+1]...)
+		}
+		lastChange = i
+	}
+
+	if current != nil {
+		result = append(result, closeHunk(current, edits, lastChange, context))
+	}
+
+	return result
+}
+
+func closeHunk(h hunk, edits []edit, lastChange, context int) hunk {
+	end := lastChange + context + 1
+	if end > len(edits) {
+		end = len(edits)
+	}
+
+	return append(h, edits[lastChange+1:end]...)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xdiff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		context int
+		want    string
+	}{
+		{
+			name: "case_equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			want: "",
+		},
+		{
+			name:    "case_add_file",
+			a:       "",
+			b:       "a\nb\n",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:    "case_remove_file",
+			a:       "a\n",
+			b:       "",
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name:    "case_change_middle",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:       "1\n2\n3\n4\nx\n6\n7\n8\n9\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -4,3 +4,3 @@\n 4\n-5\n+x\n 6\n",
+		},
+		{
+			name:    "case_two_hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:       "x\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -8,2 +8,2 @@\n 8\n-9\n+y\n",
+		},
+		{
+			name:    "case_merge_hunks",
+			a:       "1\n2\n3\n4\n",
+			b:       "x\n2\n3\ny\n",
+			context: 1,
+			want:    "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n-4\n+y\n",
+		},
+		{
+			name:    "case_no_newline_at_end",
+			a:       `{"Version":"1"}`,
+			b:       `{"Version":"2"}`,
+			context: 3,
+			want:    "--- a\n+++ b\n@@ -1 +1 @@\n-{\"Version\":\"1\"}\n\\ No newline at end of file\n+{\"Version\":\"2\"}\n\\ No newline at end of file\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("a", "b", []byte(tt.a), []byte(tt.b), tt.context); got != tt.want {
+				t.Errorf("Unified() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
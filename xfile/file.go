@@ -17,12 +17,14 @@ package xfile
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func IsFileNotExistError(err error) bool {
@@ -49,6 +51,40 @@ func FileOverwrite(fileName string, content []byte) error {
 	return nil
 }
 
+// FileLinkOrCopy hard links src to dst, content is copied if link fails, such as across devices.
+// dst is overwritten if exists.
+func FileLinkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(path.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("create dir fail, dir: %s, err: %v", path.Dir(dst), err)
+	}
+
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove file fail, file: %s, err: %v", dst, err)
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(to, from); err != nil {
+		to.Close()
+		return fmt.Errorf("copy file fail, from: %s, to: %s, err: %v", src, dst, err)
+	}
+
+	return to.Close()
+}
+
 func FileCopyRecursive(from, to string) error {
 	if bs, err := exec.Command("cp", "-rf", from, to).CombinedOutput(); err != nil {
 		return fmt.Errorf("FileCopyRecursive fail, from: %s, to: %s, err: %s", from, to, bytes.Trim(bs, "\r\n"))
@@ -85,3 +121,20 @@ func FileLink(target, linkName string) error {
 
 	return nil
 }
+
+// FileLinkAtomic links linkName to target atomically.
+// A temporary link is created then renamed to linkName, so linkName is always valid
+// during the process if it is a link file before.
+func FileLinkAtomic(target, linkName string) error {
+	tmpLink := fmt.Sprintf("%s.tmp_link_%d", linkName, time.Now().UnixNano())
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return fmt.Errorf("symlink fail, target: %s, link: %s, err: %v", target, tmpLink, err)
+	}
+
+	if err := os.Rename(tmpLink, linkName); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("rename fail, oldPath: %s, newPath: %s, err: %v", tmpLink, linkName, err)
+	}
+
+	return nil
+}
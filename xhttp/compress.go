@@ -0,0 +1,114 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+// acceptEncoding is sent by Transport if compression is enabled
+const acceptEncoding = "gzip"
+
+var (
+	httpCompressedBytes = metrics.NewCounterVec("conf_agent_http_compressed_bytes_total",
+		"bytes of response body received, before decompressed", "reloader", "host", "encoding")
+	httpDecompressedBytes = metrics.NewCounterVec("conf_agent_http_decompressed_bytes_total",
+		"bytes of response body after decompressed", "reloader", "host", "encoding")
+)
+
+// countReader counts bytes read from r
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// contentEncoding returns Content-Encoding of response, identity if not set
+func (hr *HTTPRequest) contentEncoding() string {
+	encoding := strings.ToLower(strings.TrimSpace(hr.Response.Header.Get("Content-Encoding")))
+	if encoding == "" {
+		return "identity"
+	}
+
+	return encoding
+}
+
+// decodedBody returns reader of decompressed body, and the counter of bytes received.
+// Body without content, such as response of 304 or HEAD, is not decoded.
+func (hr *HTTPRequest) decodedBody() (io.ReadCloser, *countReader, error) {
+	raw := &countReader{r: hr.Response.Body}
+
+	encoding := hr.contentEncoding()
+	if encoding == "identity" || !hr.hasBody() {
+		return ioutil.NopCloser(raw), raw, nil
+	}
+
+	// error response of a proxy may claim gzip with an empty body
+	body := bufio.NewReader(raw)
+	if _, err := body.Peek(1); err == io.EOF {
+		return ioutil.NopCloser(body), raw, nil
+	}
+
+	switch encoding {
+	case "gzip":
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gzip.NewReader fail, err: %v", err)
+		}
+		return r, raw, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+}
+
+// hasBody checks whether response may have body
+func (hr *HTTPRequest) hasBody() bool {
+	switch {
+	case hr.Request.Method == http.MethodHead:
+		return false
+	case hr.Response.StatusCode == http.StatusNotModified || hr.Response.StatusCode == http.StatusNoContent:
+		return false
+	}
+
+	return hr.Response.ContentLength != 0
+}
+
+// recordBodyBytes records bytes of body received and decompressed
+func (hr *HTTPRequest) recordBodyBytes(raw *countReader) {
+	reloader := xlog.ReloaderName(hr.ctx)
+	encoding := hr.contentEncoding()
+
+	httpCompressedBytes.Add(float64(raw.n), reloader, hr.Request.URL.Host, encoding)
+	httpDecompressedBytes.Add(float64(hr.bodySize), reloader, hr.Request.URL.Host, encoding)
+
+	if encoding != "identity" {
+		xlog.Default.Debug(xlog.InfoLogFormat(hr.ctx, "xhttp.decode", "url: ", hr.Request.URL.String(),
+			", encoding: ", encoding, ", compressed: ", raw.n, ", decompressed: ", hr.bodySize))
+	}
+}
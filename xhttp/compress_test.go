@@ -0,0 +1,159 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+func TestTransportCompression(t *testing.T) {
+	content := strings.Repeat(`{"Version": "1"}`, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write([]byte(content))
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(content))
+		gw.Close()
+	}))
+	defer server.Close()
+
+	transport, err := GetTransport(config.HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := xlog.NewContext(context.Background(), "compression_test")
+
+	req := NewHTTPRequest().Decorate(
+		HTTPRequestContextOp(ctx),
+		SimpleRequestOp(http.MethodGet, server.URL, nil),
+		HTTPRequestTransportOp(transport)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if string(req.RawContent) != content || req.BodySize() != int64(len(content)) {
+		t.Errorf("body is not decompressed, size: %d", req.BodySize())
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, name := range []string{"conf_agent_http_compressed_bytes_total", "conf_agent_http_decompressed_bytes_total"} {
+		if !regexp.MustCompile(name + `\{.*reloader="compression_test"`).MatchString(rec.Body.String()) {
+			t.Errorf("%s of gzip response not recorded", name)
+		}
+	}
+
+	// max body size limits decompressed body
+	var w bytes.Buffer
+	req = NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, server.URL, nil),
+		HTTPRequestTransportOp(transport),
+		HTTPRequestMaxBodySizeOp(int64(len(content)-1))).
+		Do().
+		Decorate(RspBodyWriterOp(&w))
+	if req.Err() == nil {
+		t.Errorf("want error when decompressed body exceeds max size")
+	}
+
+	// compression is disabled
+	transport, err = GetTransport(config.HTTPClientConfig{DisableCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, server.URL, nil),
+		HTTPRequestTransportOp(transport)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if req.Response.Header.Get("Content-Encoding") != "" || string(req.RawContent) != content {
+		t.Errorf("response should not be compressed")
+	}
+}
+
+func TestDecodeBodyWithoutContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/not_modified":
+			w.WriteHeader(http.StatusNotModified)
+		case "/empty":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/empty_chunked":
+			// no Content-Length
+			w.WriteHeader(http.StatusInternalServerError)
+			w.(http.Flusher).Flush()
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			gw := gzip.NewWriter(w)
+			gw.Write([]byte("upstream fail"))
+			gw.Close()
+		}
+	}))
+	defer server.Close()
+
+	transport, err := GetTransport(config.HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, path string, op HTTPRequestOp) *HTTPRequest {
+		return NewHTTPRequest().Decorate(
+			SimpleRequestOp(method, server.URL+path, nil),
+			HTTPRequestTransportOp(transport)).
+			Do().
+			Decorate(RspBodyRawReaderOp, op)
+	}
+
+	// 304 takes the not modified path
+	req := request(http.MethodGet, "/not_modified", RspCode200Or304Op)
+	if err := req.Err(); err != nil || !req.NotModified() {
+		t.Errorf("304: err = %v, NotModified() = %v", err, req.NotModified())
+	}
+
+	// HEAD has no body
+	if err := request(http.MethodHead, "/empty", RspCode200Op).Err(); err == nil || !strings.Contains(err.Error(), "StatuCode: 500") {
+		t.Errorf("HEAD: err = %v, want bad status code", err)
+	}
+
+	// empty error body is not decoded
+	for _, path := range []string{"/empty", "/empty_chunked"} {
+		if err := request(http.MethodGet, path, RspCode200Op).Err(); err == nil || !strings.Contains(err.Error(), "StatuCode: 500") {
+			t.Errorf("%s: err = %v, want bad status code", path, err)
+		}
+	}
+
+	// compressed error body is decoded
+	if err := request(http.MethodGet, "/fail", RspCode200Op).Err(); err == nil || !strings.Contains(err.Error(), "StatuCode: 502, Raw: upstream fail") {
+		t.Errorf("502: err = %v, want decoded body in error", err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/baidu/conf-agent/metrics"
+)
+
+const (
+	// EndpointFailover always tries endpoints in configured order
+	EndpointFailover = "failover"
+	// EndpointRoundRobin starts from the next endpoint for every request
+	EndpointRoundRobin = "round_robin"
+)
+
+var endpointHealthy = metrics.NewGaugeVec("conf_agent_endpoint_healthy",
+	"1 if endpoint is healthy, 0 if it's in cooldown after failure", "endpoint")
+
+// endpointHealth keeps unhealthy endpoints, it's shared by all pools
+var endpointHealth = struct {
+	lock           sync.Mutex
+	unhealthyUntil map[string]time.Time
+}{
+	unhealthyUntil: map[string]time.Time{},
+}
+
+func markEndpoint(endpoint string, healthy bool, cooldown time.Duration) {
+	endpointHealth.lock.Lock()
+	defer endpointHealth.lock.Unlock()
+
+	if healthy || cooldown <= 0 {
+		delete(endpointHealth.unhealthyUntil, endpoint)
+		endpointHealthy.Set(1, endpoint)
+		return
+	}
+
+	endpointHealth.unhealthyUntil[endpoint] = time.Now().Add(cooldown)
+	endpointHealthy.Set(0, endpoint)
+}
+
+func endpointUnhealthy(endpoint string, now time.Time) bool {
+	endpointHealth.lock.Lock()
+	defer endpointHealth.lock.Unlock()
+
+	return now.Before(endpointHealth.unhealthyUntil[endpoint])
+}
+
+// EndpointPool selects endpoints of a server for requests.
+// Endpoint fails a request is unhealthy for cooldown, it's tried only if all endpoints are unhealthy.
+type EndpointPool struct {
+	endpoints []string
+	strategy  string
+	cooldown  time.Duration
+
+	// next is the start of round robin
+	next uint32
+
+	// current is the endpoint of the last attempt of failover strategy
+	currentLock sync.Mutex
+	current     string
+}
+
+func NewEndpointPool(endpoints []string, strategy string, cooldown time.Duration) *EndpointPool {
+	return &EndpointPool{
+		endpoints: endpoints,
+		strategy:  strategy,
+		cooldown:  cooldown,
+	}
+}
+
+// candidates returns endpoints in the order to try, healthy ones first
+func (pool *EndpointPool) candidates() []string {
+	start := 0
+	if pool.strategy == EndpointRoundRobin && len(pool.endpoints) > 0 {
+		start = int(atomic.AddUint32(&pool.next, 1)-1) % len(pool.endpoints)
+	}
+
+	now := time.Now()
+	healthy, unhealthy := []string{}, []string{}
+	for i := range pool.endpoints {
+		endpoint := pool.endpoints[(start+i)%len(pool.endpoints)]
+		if endpointUnhealthy(endpoint, now) {
+			unhealthy = append(unhealthy, endpoint)
+		} else {
+			healthy = append(healthy, endpoint)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+// switchTo records endpoint as the current one, returns the previous one if endpoint is switched.
+// Round robin switches endpoints for every request, so it never reports.
+func (pool *EndpointPool) switchTo(endpoint string) (string, bool) {
+	if pool.strategy == EndpointRoundRobin {
+		return "", false
+	}
+
+	pool.currentLock.Lock()
+	defer pool.currentLock.Unlock()
+
+	prev := pool.current
+	pool.current = endpoint
+
+	return prev, prev != "" && prev != endpoint
+}
+
+// HTTPRequestEndpointOp sends request to an endpoint of pool, url of request should be relative to endpoint.
+// Every attempt of Do tries the next candidate, so retries fail over to other endpoints.
+func HTTPRequestEndpointOp(pool *EndpointPool) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		if len(pool.endpoints) == 0 {
+			return fmt.Errorf("no endpoint")
+		}
+
+		hr.endpoints = pool
+		return nil
+	}
+}
+
+// selectEndpoint sets url of request to the endpoint for attempt, returns the endpoint
+func (hr *HTTPRequest) selectEndpoint(candidates []string, relativeURL string, attempt int) (string, error) {
+	endpoint := candidates[(attempt-1)%len(candidates)]
+
+	u, err := url.Parse(endpoint + relativeURL)
+	if err != nil {
+		return endpoint, err
+	}
+	hr.Request.URL = u
+	hr.Request.Host = u.Host
+
+	return endpoint, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countServer struct {
+	*httptest.Server
+	count int32
+}
+
+func newCountServer(code int) *countServer {
+	s := &countServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.count, 1)
+		if r.URL.Path != "/api" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(code)
+	}))
+
+	return s
+}
+
+func doEndpointRequest(t *testing.T, pool *EndpointPool, attempts int) int {
+	req := NewHTTPRequest().
+		Decorate(
+			SimpleRequestOp(http.MethodGet, "/api", nil),
+			HTTPRequestEndpointOp(pool),
+			HTTPRequestRetryOp(attempts, testBackoff)).
+		Do()
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	req.Response.Body.Close()
+
+	return req.Response.StatusCode
+}
+
+func TestEndpointFailover(t *testing.T) {
+	bad := newCountServer(http.StatusBadGateway)
+	defer bad.Close()
+	good := newCountServer(http.StatusOK)
+	defer good.Close()
+
+	pool := NewEndpointPool([]string{bad.URL, good.URL}, EndpointFailover, time.Hour)
+
+	// fail over to the second endpoint in retry
+	if code := doEndpointRequest(t, pool, 2); code != http.StatusOK {
+		t.Fatalf("got code %d, want 200", code)
+	}
+
+	// unhealthy endpoint is skipped
+	if code := doEndpointRequest(t, pool, 1); code != http.StatusOK {
+		t.Fatalf("got code %d, want 200", code)
+	}
+
+	if bad.count != 1 || good.count != 2 {
+		t.Errorf("got requests %d/%d, want 1/2", bad.count, good.count)
+	}
+	if pool.current != good.URL {
+		t.Errorf("current endpoint = %s, want %s", pool.current, good.URL)
+	}
+}
+
+func TestEndpointPoolSwitchTo(t *testing.T) {
+	pool := NewEndpointPool([]string{"http://a", "http://b"}, EndpointFailover, time.Hour)
+
+	steps := []struct {
+		endpoint string
+		prev     string
+		switched bool
+	}{
+		{endpoint: "http://a", prev: "", switched: false},
+		{endpoint: "http://a", prev: "http://a", switched: false},
+		{endpoint: "http://b", prev: "http://a", switched: true},
+		{endpoint: "http://a", prev: "http://b", switched: true},
+	}
+	for i, step := range steps {
+		if prev, switched := pool.switchTo(step.endpoint); prev != step.prev || switched != step.switched {
+			t.Errorf("step %d: switchTo(%s) = %s, %v, want %s, %v", i, step.endpoint, prev, switched, step.prev, step.switched)
+		}
+	}
+
+	pool = NewEndpointPool([]string{"http://a", "http://b"}, EndpointRoundRobin, time.Hour)
+	pool.switchTo("http://a")
+	if _, switched := pool.switchTo("http://b"); switched {
+		t.Errorf("round robin should not report switch")
+	}
+}
+
+func TestEndpointRoundRobin(t *testing.T) {
+	a := newCountServer(http.StatusOK)
+	defer a.Close()
+	b := newCountServer(http.StatusOK)
+	defer b.Close()
+
+	pool := NewEndpointPool([]string{a.URL, b.URL}, EndpointRoundRobin, time.Hour)
+	for i := 0; i < 4; i++ {
+		doEndpointRequest(t, pool, 1)
+	}
+
+	if a.count != 2 || b.count != 2 {
+		t.Errorf("got requests %d/%d, want 2/2", a.count, b.count)
+	}
+}
@@ -15,17 +15,42 @@
 package xhttp
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xbackoff"
+	"github.com/baidu/conf-agent/xlog"
 )
 
+var httpResponses = metrics.NewCounterVec("conf_agent_http_responses_total",
+	"count of http responses by status code, code is error if no response received", "reloader", "host", "code")
+
 type HTTPRequest struct {
 	Client *http.Client
 
+	// ctx is bound to Request when Do
+	ctx context.Context
+	// retry is zero if Do makes one attempt only
+	retry retryPolicy
+	// endpoints is nil if url of Request is absolute
+	endpoints *EndpointPool
+	// transport replaces the transport of Client if not nil
+	transport http.RoundTripper
+	// timeout limits each attempt by context, including reading body, 0 means no timeout
+	timeout time.Duration
+	// maxBodySize limits size of response body, 0 means no limit
+	maxBodySize int64
+	// bodySize is the size of response body read or written
+	bodySize int64
+
 	Request *http.Request
 
 	Response   *http.Response
@@ -47,11 +72,104 @@ func RspBodyRawReaderOp(hr *HTTPRequest) error {
 	if hr.Response == nil {
 		return fmt.Errorf("body is nil")
 	}
-
-	hr.RawContent, hr.err = ioutil.ReadAll(hr.Response.Body)
 	defer hr.Response.Body.Close()
 
-	return hr.err
+	if err := hr.checkContentLength(); err != nil {
+		return err
+	}
+
+	body, raw, err := hr.decodedBody()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	hr.RawContent, hr.err = ioutil.ReadAll(hr.limitedBody(body))
+	hr.bodySize = int64(len(hr.RawContent))
+	hr.recordBodyBytes(raw)
+	if hr.err != nil {
+		return hr.err
+	}
+
+	return hr.checkBodySize()
+}
+
+// RspBodyWriterOp streams response body to w, RawContent is not set
+func RspBodyWriterOp(w io.Writer) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		if hr.Response == nil {
+			return fmt.Errorf("body is nil")
+		}
+		defer hr.Response.Body.Close()
+
+		if err := hr.checkContentLength(); err != nil {
+			return err
+		}
+
+		body, raw, err := hr.decodedBody()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		hr.bodySize, hr.err = io.Copy(w, hr.limitedBody(body))
+		hr.recordBodyBytes(raw)
+		if hr.err != nil {
+			return hr.err
+		}
+
+		return hr.checkBodySize()
+	}
+}
+
+// HTTPRequestMaxBodySizeOp fails request if response body is larger than size, 0 means no limit
+func HTTPRequestMaxBodySizeOp(size int64) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		hr.maxBodySize = size
+		return nil
+	}
+}
+
+// limitedBody reads one more byte than maxBodySize from decompressed body, so an oversized body is detected
+func (hr *HTTPRequest) limitedBody(body io.Reader) io.Reader {
+	if hr.maxBodySize <= 0 {
+		return body
+	}
+
+	return io.LimitReader(body, hr.maxBodySize+1)
+}
+
+// checkContentLength fails early if body is not compressed and larger than maxBodySize
+func (hr *HTTPRequest) checkContentLength() error {
+	if hr.contentEncoding() != "identity" {
+		return nil
+	}
+
+	if hr.maxBodySize > 0 && hr.Response.ContentLength > hr.maxBodySize {
+		return fmt.Errorf("body size %d exceeds max size %d", hr.Response.ContentLength, hr.maxBodySize)
+	}
+
+	return nil
+}
+
+func (hr *HTTPRequest) checkBodySize() error {
+	if hr.maxBodySize > 0 && hr.bodySize > hr.maxBodySize {
+		return fmt.Errorf("body exceeds max size %d", hr.maxBodySize)
+	}
+
+	return nil
+}
+
+// BodySize returns size of response body read or written, after decompressed
+func (hr *HTTPRequest) BodySize() int64 {
+	return hr.bodySize
+}
+
+// Close closes response body, it's safe to call after body is read
+func (hr *HTTPRequest) Close() {
+	if hr.Response != nil {
+		hr.Response.Body.Close()
+	}
 }
 
 func RspBodyJSONReader(ds ...interface{}) HTTPRequestOp {
@@ -86,32 +204,66 @@ func HTTPRequestHeaderOp(header map[string]string) HTTPRequestOp {
 func SimpleRequestOp(method, url string, body io.Reader) HTTPRequestOp {
 	return func(hr *HTTPRequest) error {
 		var err error
-		hr.Request, err = http.NewRequest(http.MethodGet, url, body)
+		hr.Request, err = http.NewRequest(method, url, body)
 		return err
 	}
 }
 
-func HTTPRequestTimeoutOp(timeout time.Duration) HTTPRequestOp {
+// JSONRequestOp creates request with v encoded as JSON body, the body can be resent when retry
+func JSONRequestOp(method, url string, v interface{}) HTTPRequestOp {
 	return func(hr *HTTPRequest) error {
-		if timeout < 1 {
-			return nil
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("json.Marshal fail, err: %v", err)
 		}
 
-		hr.Client = &http.Client{
-			Timeout: timeout,
+		if hr.Request, err = http.NewRequest(method, url, bytes.NewReader(bs)); err != nil {
+			return err
 		}
+		hr.Request.Header.Set("Content-Type", "application/json")
 
 		return nil
 	}
 }
 
-var defaultClient = &http.Client{
-	Timeout: 10 * time.Second,
+// HTTPRequestContextOp binds ctx to the request
+func HTTPRequestContextOp(ctx context.Context) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		hr.ctx = ctx
+		return nil
+	}
+}
+
+// HTTPClientOp sends the request by client
+func HTTPClientOp(client *http.Client) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		hr.Client = client
+		return nil
+	}
+}
+
+// HTTPRequestTimeoutOp limits each attempt to timeout, 0 means no timeout, such as a stream
+func HTTPRequestTimeoutOp(timeout time.Duration) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		if timeout < 0 {
+			return nil
+		}
+
+		hr.timeout = timeout
+		return nil
+	}
 }
 
+// defaultClient is shared by requests, timeout is applied by context of request,
+// so connections of its transport are reused
+var defaultClient = &http.Client{}
+
+const defaultTimeout = 10 * time.Second
+
 func NewHTTPRequest() *HTTPRequest {
 	return &HTTPRequest{
-		Client: defaultClient,
+		Client:  defaultClient,
+		timeout: defaultTimeout,
 	}
 }
 
@@ -131,8 +283,108 @@ func (hr *HTTPRequest) Do() *HTTPRequest {
 		return hr
 	}
 
-	hr.Response, hr.err = hr.Client.Do(hr.Request)
-	return hr
+	if hr.ctx == nil {
+		hr.ctx = context.Background()
+	}
+	ctx := hr.ctx
+	hr.setIdentityHeaders()
+
+	client := hr.Client
+	if hr.transport != nil {
+		c := *hr.Client
+		c.Transport = hr.transport
+		client = &c
+	}
+
+	var candidates []string
+	relativeURL := ""
+	if hr.endpoints != nil {
+		candidates = hr.endpoints.candidates()
+		relativeURL = hr.Request.URL.String()
+	}
+
+	for attempt := 1; ; attempt++ {
+		endpoint := ""
+		if candidates != nil {
+			if endpoint, hr.err = hr.selectEndpoint(candidates, relativeURL, attempt); hr.err != nil {
+				return hr
+			}
+			if prev, switched := hr.endpoints.switchTo(endpoint); switched {
+				xlog.Default.Info(xlog.InfoLogFormat(ctx, "xhttp.Do", "switch endpoint from ", prev, " to ", endpoint))
+			}
+		}
+
+		hr.Response, hr.err = hr.send(ctx, client)
+
+		code := "error"
+		if hr.Response != nil {
+			code = strconv.Itoa(hr.Response.StatusCode)
+		}
+		httpResponses.Inc(xlog.ReloaderName(ctx), hr.Request.URL.Host, code)
+		xlog.Default.Debug(xlog.InfoLogFormat(ctx, "xhttp.Do", "attempt ", attempt, ", url: ", hr.Request.URL.String(), ", code: ", code))
+
+		failed := retryable(ctx, hr.Response, hr.err)
+		if endpoint != "" && ctx.Err() == nil {
+			markEndpoint(endpoint, !failed, hr.endpoints.cooldown)
+			if failed {
+				xlog.Default.Info(xlog.InfoLogFormat(ctx, "xhttp.Do", "endpoint ", endpoint, " unhealthy for ", hr.endpoints.cooldown.String()))
+			}
+		}
+
+		if attempt >= hr.retry.attempts || !failed {
+			return hr
+		}
+
+		delay := hr.retryDelay(attempt)
+
+		// no time left for another attempt
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return hr
+		}
+
+		if !rewindBody(hr.Request) {
+			return hr
+		}
+
+		xlog.Default.Info(xlog.InfoLogFormat(ctx, "xhttp.Do", "attempt ", attempt, " fail, url: ", hr.Request.URL.String(),
+			", code: ", code, ", err: ", hr.err, ", retry after ", delay.String()))
+		discardResponse(hr.Response)
+
+		if !xbackoff.Sleep(ctx, delay) {
+			hr.Response, hr.err = nil, ctx.Err()
+			return hr
+		}
+	}
+}
+
+// send makes an attempt with timeout, the timeout context is released when body of response is closed
+func (hr *HTTPRequest) send(ctx context.Context, client *http.Client) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if hr.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, hr.timeout)
+	}
+	hr.Request = hr.Request.WithContext(ctx)
+
+	rsp, err := client.Do(hr.Request)
+	if err != nil {
+		cancel()
+		return rsp, err
+	}
+
+	rsp.Body = &cancelBody{ReadCloser: rsp.Body, cancel: cancel}
+	return rsp, nil
+}
+
+// cancelBody cancels context of request when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 func (hr *HTTPRequest) Err() error {
@@ -0,0 +1,108 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONRequestOp(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// the first attempt fails, body is sent again in retry
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, body["name"])
+	}))
+	defer server.Close()
+
+	req := NewHTTPRequest().
+		Decorate(
+			JSONRequestOp(http.MethodPut, server.URL, map[string]string{"name": "agent"}),
+			HTTPRequestRetryOp(2, testBackoff)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(req.RawContent); got != "PUT agent" {
+		t.Errorf("response = %s, want PUT agent", got)
+	}
+}
+
+func TestHTTPRequestMaxBodySizeOp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// chunked response has no Content-Length
+		if r.URL.Path == "/chunked" {
+			w.Write([]byte("0123"))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("456789"))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/", "/chunked"} {
+		req := NewHTTPRequest().Decorate(
+			SimpleRequestOp(http.MethodGet, server.URL+path, nil),
+			HTTPRequestMaxBodySizeOp(5)).
+			Do().
+			Decorate(RspBodyRawReaderOp)
+		if req.Err() == nil {
+			t.Errorf("%s: want error when body exceeds max size", path)
+		}
+
+		var buf bytes.Buffer
+		req = NewHTTPRequest().Decorate(
+			SimpleRequestOp(http.MethodGet, server.URL+path, nil),
+			HTTPRequestMaxBodySizeOp(5)).
+			Do().
+			Decorate(RspBodyWriterOp(&buf))
+		if req.Err() == nil {
+			t.Errorf("%s: want error when streamed body exceeds max size", path)
+		}
+	}
+
+	var buf bytes.Buffer
+	req := NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, server.URL+"/chunked", nil),
+		HTTPRequestMaxBodySizeOp(10)).
+		Do().
+		Decorate(RspBodyWriterOp(&buf))
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "0123456789" || req.BodySize() != 10 {
+		t.Errorf("body = %s, size = %d", buf.String(), req.BodySize())
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"os"
+	"sync"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/version"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+// userAgent is sent with every request
+var userAgent = "conf-agent/" + version.Version
+
+// identity is sent with every request, so server can trace and rate-limit per agent.
+// Only User-Agent is sent before SetIdentity.
+var identity = struct {
+	lock sync.RWMutex
+	c    config.IdentityConfig
+}{
+	c: config.IdentityConfig{Hostname: hostname()},
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// SetIdentity sets identity headers of requests, Hostname is hostname of os if not set
+func SetIdentity(c config.IdentityConfig) {
+	if c.Hostname == "" {
+		c.Hostname = hostname()
+	}
+
+	identity.lock.Lock()
+	defer identity.lock.Unlock()
+
+	identity.c = c
+}
+
+// Identity returns identity set by SetIdentity
+func Identity() config.IdentityConfig {
+	identity.lock.RLock()
+	defer identity.lock.RUnlock()
+
+	return identity.c
+}
+
+// setIdentityHeaders sets User-Agent, LogID of ctx and identity headers, headers set by ops are kept
+func (hr *HTTPRequest) setIdentityHeaders() {
+	c := Identity()
+	logCtx := xlog.GetLogContext(hr.ctx)
+
+	for _, h := range []struct {
+		name  string
+		value string
+	}{
+		{"User-Agent", userAgent},
+		{c.RequestIDHeader, logCtx.LogID},
+		{c.HostnameHeader, c.Hostname},
+		{c.InstanceIDHeader, c.InstanceID},
+		{c.ReloaderHeader, logCtx.ReloaderName},
+	} {
+		if h.name == "" || h.value == "" || hr.Request.Header.Get(h.name) != "" {
+			continue
+		}
+		hr.Request.Header.Set(h.name, h.value)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/version"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+func TestIdentityHeaders(t *testing.T) {
+	header := http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	old := Identity()
+	defer SetIdentity(old)
+	SetIdentity(config.IdentityConfig{
+		RequestIDHeader:  "X-Request-Id",
+		HostnameHeader:   "X-Conf-Agent-Hostname",
+		InstanceIDHeader: "X-Conf-Agent-Instance-Id",
+		ReloaderHeader:   "X-Conf-Agent-Reloader",
+		Hostname:         "bfe-01",
+	})
+
+	ctx := xlog.NewContext(context.Background(), "tls_conf")
+	err := NewHTTPRequest().Decorate(
+		HTTPRequestContextOp(ctx),
+		SimpleRequestOp(http.MethodGet, server.URL, nil),
+		HTTPRequestHeaderOp(map[string]string{"X-Conf-Agent-Reloader": "custom"})).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op).
+		Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"User-Agent":            "conf-agent/" + version.Version,
+		"X-Request-Id":          xlog.GetLogContext(ctx).LogID,
+		"X-Conf-Agent-Hostname": "bfe-01",
+		// header set by op is kept
+		"X-Conf-Agent-Reloader": "custom",
+		// instance id is not set
+		"X-Conf-Agent-Instance-Id": "",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("header %s = %q, want %q", name, got, want)
+		}
+	}
+}
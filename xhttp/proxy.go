@@ -0,0 +1,82 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/baidu/conf-agent/config"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyFunc returns the proxy of transport.
+// Proxies of environment(HTTP_PROXY/HTTPS_PROXY/NO_PROXY) are used unless they are configured.
+func proxyFunc(c config.ProxyConfig) (func(*http.Request) (*url.URL, error), error) {
+	// httpproxy reports bad proxy only when a request is sent, check them here
+	for _, proxy := range []string{c.HTTPProxy, c.HTTPSProxy} {
+		if err := checkProxy(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	proxyConfig := httpproxy.FromEnvironment()
+	if c.HTTPProxy != "" {
+		proxyConfig.HTTPProxy = c.HTTPProxy
+	}
+	if c.HTTPSProxy != "" {
+		proxyConfig.HTTPSProxy = c.HTTPSProxy
+	}
+	if c.NoProxy != "" {
+		proxyConfig.NoProxy = c.NoProxy
+	}
+	proxy := proxyConfig.ProxyFunc()
+
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
+
+// checkProxy returns error if proxy is not empty and has no host, scheme is http if not set
+func checkProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("bad proxy %s, err: %v", proxy, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("bad proxy %s, no host", proxy)
+	}
+
+	return nil
+}
+
+// unixDialer dials socket whatever address is requested
+func unixDialer(dialer *net.Dialer, socket string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+func TestProxyFunc(t *testing.T) {
+	proxy, err := proxyFunc(config.ProxyConfig{
+		HTTPProxy:  "proxy:8080",
+		HTTPSProxy: "http://secure-proxy:8080",
+		NoProxy:    "example.com, .internal, 10.0.0.0/8, 192.168.1.1, conf.local:8080",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url   string
+		proxy string
+	}{
+		{"http://example.com", ""},
+		{"http://api.example.com:8183", ""},
+		{"http://badexample.com", "http://proxy:8080"},
+		{"https://conf.internal", ""},
+		{"https://internal", "http://secure-proxy:8080"},
+		{"http://10.1.2.3:8183", ""},
+		{"http://11.1.2.3:8183", "http://proxy:8080"},
+		{"https://192.168.1.1:443", ""},
+		{"http://conf.local:8080", ""},
+		{"http://conf.local", "http://proxy:8080"},
+		{"http://localhost:8183", ""},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatalf("proxy of %s error = %v", c.url, err)
+		}
+
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != c.proxy {
+			t.Errorf("proxy of %s = %q, want %q", c.url, got, c.proxy)
+		}
+	}
+
+	proxy, err = proxyFunc(config.ProxyConfig{HTTPProxy: "proxy:8080", NoProxy: "*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://any.host", nil)
+	if u, _ := proxy(req); u != nil {
+		t.Errorf("* should match any host, got proxy %s", u)
+	}
+}
+
+// setenv sets environment variable key to value until the test ends, empty value unsets it
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+}
+
+func TestProxyFuncEnvironment(t *testing.T) {
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "REQUEST_METHOD"} {
+		setenv(t, key, "")
+		setenv(t, strings.ToLower(key), "")
+	}
+	setenv(t, "HTTP_PROXY", "http://env-proxy:8080")
+
+	// only NoProxy is configured, it excludes hosts from proxy of environment
+	proxy, err := proxyFunc(config.ProxyConfig{NoProxy: "conf.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for url, want := range map[string]string{
+		"http://conf.internal:8183": "",
+		"http://other.example":      "http://env-proxy:8080",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatalf("proxy of %s error = %v", url, err)
+		}
+
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("proxy of %s = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	// proxy replies the host requested through it
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "proxy %s", r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer direct.Close()
+
+	transport, err := GetTransport(config.HTTPClientConfig{
+		Proxy: config.ProxyConfig{
+			HTTPProxy: proxy.URL,
+			NoProxy:   "127.0.0.1",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for url, want := range map[string]string{
+		"http://conf.example:8183/api": "proxy conf.example:8183",
+		direct.URL:                     "direct",
+	} {
+		req := NewHTTPRequest().Decorate(
+			SimpleRequestOp(http.MethodGet, url, nil),
+			HTTPRequestTransportOp(transport)).
+			Do().
+			Decorate(RspBodyRawReaderOp, RspCode200Op)
+		if err := req.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(req.RawContent); got != want {
+			t.Errorf("response of %s = %s, want %s", url, got, want)
+		}
+	}
+
+	if _, err := GetTransport(config.HTTPClientConfig{Proxy: config.ProxyConfig{HTTPSProxy: "http://"}}); err == nil {
+		t.Errorf("want error of proxy without host")
+	}
+}
+
+func TestTransportUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "forwarder.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s%s", r.Host, r.URL.Path)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	transport, err := GetTransport(config.HTTPClientConfig{
+		UnixSocket: socket,
+		Proxy:      config.ProxyConfig{HTTPProxy: "http://127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, "http://conf.example/api", nil),
+		HTTPRequestTransportOp(transport)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if err := req.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(req.RawContent); got != "conf.example/api" {
+		t.Errorf("response = %s, want conf.example/api", got)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baidu/conf-agent/xbackoff"
+)
+
+// retryPolicy decides how Do retries a request
+type retryPolicy struct {
+	// attempts is the max count of attempts, including the first one
+	attempts int
+	backoff  xbackoff.Backoff
+}
+
+// HTTPRequestRetryOp makes Do retry on network errors and 5xx/429 responses, at most attempts times in total.
+// Delay between attempts follows backoff, or Retry-After of response if set,
+// which is limited to backoff.Max and the timeout of each attempt.
+// No more attempt is made if the delay exceeds the deadline of request context.
+func HTTPRequestRetryOp(attempts int, backoff xbackoff.Backoff) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		hr.retry = retryPolicy{
+			attempts: attempts,
+			backoff:  backoff,
+		}
+		return nil
+	}
+}
+
+// retryable returns true if the result of an attempt is worth retrying
+func retryable(ctx context.Context, rsp *http.Response, err error) bool {
+	if err != nil {
+		// canceled or deadline exceeded by caller
+		return ctx.Err() == nil
+	}
+
+	return rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryAfter parses Retry-After of response, which is seconds or a http date
+func retryAfter(rsp *http.Response) (time.Duration, bool) {
+	if rsp == nil {
+		return 0, false
+	}
+
+	value := rsp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// retryDelay returns the delay before the next attempt.
+// Retry-After is clamped, so a server can't stall the client much longer than backoff.
+func (hr *HTTPRequest) retryDelay(attempt int) time.Duration {
+	delay, ok := retryAfter(hr.Response)
+	if !ok {
+		return hr.retry.backoff.Delay(attempt)
+	}
+
+	if max := hr.retry.backoff.Max; max > 0 && delay > max {
+		delay = max
+	}
+	if hr.timeout > 0 && delay > hr.timeout {
+		delay = hr.timeout
+	}
+
+	return delay
+}
+
+// rewindBody resets body of request before a retry, returns false if body can't be read again
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+
+	if req.GetBody == nil {
+		return false
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+
+	return true
+}
+
+// discardResponse drains and closes body of a response which is retried, so its connection can be reused
+func discardResponse(rsp *http.Response) {
+	if rsp == nil {
+		return
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(rsp.Body, 4096))
+	rsp.Body.Close()
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/xbackoff"
+)
+
+var testBackoff = xbackoff.Backoff{
+	Min:        time.Millisecond,
+	Max:        10 * time.Millisecond,
+	Multiplier: 2,
+}
+
+func TestHTTPRequestRetryOp(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		attempts int
+
+		wantCode     int
+		wantAttempts int32
+	}{
+		{
+			name:         "case_retry_5xx",
+			codes:        []int{502, 503, 200},
+			attempts:     3,
+			wantCode:     200,
+			wantAttempts: 3,
+		},
+		{
+			name:         "case_retry_429",
+			codes:        []int{429, 200},
+			attempts:     3,
+			wantCode:     200,
+			wantAttempts: 2,
+		},
+		{
+			name:         "case_attempts_used_up",
+			codes:        []int{500, 500, 500},
+			attempts:     2,
+			wantCode:     500,
+			wantAttempts: 2,
+		},
+		{
+			name:         "case_no_retry_4xx",
+			codes:        []int{404, 200},
+			attempts:     3,
+			wantCode:     404,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&count, 1) - 1
+
+				// body is sent again in every attempt
+				body, _ := ioutil.ReadAll(r.Body)
+				if string(body) != "body" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+
+				if tt.codes[i] == http.StatusTooManyRequests {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(tt.codes[i])
+			}))
+			defer server.Close()
+
+			req := NewHTTPRequest().
+				Decorate(
+					SimpleRequestOp(http.MethodPost, server.URL, bytes.NewReader([]byte("body"))),
+					HTTPRequestRetryOp(tt.attempts, testBackoff)).
+				Do()
+			if err := req.Err(); err != nil {
+				t.Fatal(err)
+			}
+			req.Response.Body.Close()
+
+			if req.Response.StatusCode != tt.wantCode {
+				t.Errorf("got code %d, want %d", req.Response.StatusCode, tt.wantCode)
+			}
+			if count != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", count, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestHTTPRequestRetryOpDeadline(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Max of backoff doesn't limit Retry-After to less than deadline
+	backoff := testBackoff
+	backoff.Max = 2 * time.Hour
+
+	begin := time.Now()
+	req := NewHTTPRequest().
+		Decorate(
+			HTTPRequestContextOp(ctx),
+			SimpleRequestOp(http.MethodGet, server.URL, nil),
+			HTTPRequestRetryOp(3, backoff)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if req.Err() == nil {
+		t.Errorf("want error")
+	}
+	if count != 1 {
+		t.Errorf("got %d attempts, want 1", count)
+	}
+	if time.Since(begin) > 500*time.Millisecond {
+		t.Errorf("retry is not given up when Retry-After exceeds deadline")
+	}
+}
+
+func TestHTTPRequestRetryOpClampRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff xbackoff.Backoff
+		timeout time.Duration
+
+		wantDelay time.Duration
+	}{
+		{
+			name:      "case_clamp_to_backoff_max",
+			backoff:   testBackoff,
+			wantDelay: testBackoff.Max,
+		},
+		{
+			name:      "case_clamp_to_timeout",
+			backoff:   xbackoff.Backoff{Min: time.Millisecond, Max: time.Hour},
+			timeout:   20 * time.Millisecond,
+			wantDelay: 20 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&count, 1) == 1 {
+					w.Header().Set("Retry-After", "86400")
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			req := NewHTTPRequest().
+				Decorate(
+					SimpleRequestOp(http.MethodGet, server.URL, nil),
+					HTTPRequestTimeoutOp(tt.timeout),
+					HTTPRequestRetryOp(2, tt.backoff))
+			req.Response = &http.Response{Header: http.Header{"Retry-After": []string{"86400"}}}
+			if got := req.retryDelay(1); got != tt.wantDelay {
+				t.Errorf("retryDelay() = %s, want %s", got, tt.wantDelay)
+			}
+			req.Response = nil
+
+			begin := time.Now()
+			req.Do().Decorate(RspBodyRawReaderOp, RspCode200Op)
+			if err := req.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if count != 2 {
+				t.Errorf("got %d attempts, want 2", count)
+			}
+			if cost := time.Since(begin); cost > 5*time.Second {
+				t.Errorf("Do() cost %s, Retry-After is not clamped", cost)
+			}
+		})
+	}
+}
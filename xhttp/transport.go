@@ -0,0 +1,270 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+	"github.com/baidu/conf-agent/metrics"
+	"github.com/baidu/conf-agent/xlog"
+)
+
+var httpConnections = metrics.NewCounterVec("conf_agent_http_connections_total",
+	"count of connections dialed, it grows slowly if connections are reused", "addr")
+
+// reloadCheckInterval is the min interval to check whether certificate files changed
+const reloadCheckInterval = time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Transport is a http.RoundTripper built from config.HTTPClientConfig.
+// It rebuilds the underlying transport when certificate files change on disk.
+type Transport struct {
+	config config.HTTPClientConfig
+
+	lock      sync.Mutex
+	transport *http.Transport
+	// stamps of certificate files used by transport
+	stamps    map[string]fileStamp
+	checkedAt time.Time
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// transports are shared by requests with the same config, so connections are reused
+var transports = struct {
+	lock sync.Mutex
+	m    map[config.HTTPClientConfig]*Transport
+}{
+	m: map[config.HTTPClientConfig]*Transport{},
+}
+
+// GetTransport returns the transport of config, it's created at first call
+func GetTransport(c config.HTTPClientConfig) (*Transport, error) {
+	transports.lock.Lock()
+	defer transports.lock.Unlock()
+
+	if t, ok := transports.m[c]; ok {
+		return t, nil
+	}
+
+	t := &Transport{config: c}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	transports.m[c] = t
+
+	return t, nil
+}
+
+// HTTPRequestTransportOp sends request by rt
+func HTTPRequestTransportOp(rt http.RoundTripper) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		hr.transport = rt
+		return nil
+	}
+}
+
+// RoundTrip sends req, Accept-Encoding is added if compression is enabled and req has none.
+// Compressed body is decoded by xhttp instead of http.Transport, so bytes received can be counted.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.config.DisableCompression && req.Header.Get("Accept-Encoding") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+
+	return t.current(req.Context()).RoundTrip(req)
+}
+
+// current returns the transport to use, reloads it if certificate files changed.
+// If reload fails, such as a file is half written, the old transport is kept.
+func (t *Transport) current(ctx context.Context) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if time.Since(t.checkedAt) < reloadCheckInterval {
+		return t.transport
+	}
+	t.checkedAt = time.Now()
+
+	if !t.changed() {
+		return t.transport
+	}
+
+	old := t.transport
+	if err := t.reload(); err != nil {
+		xlog.Default.Error(xlog.ErrLogFormat(ctx, "Transport.reload", err))
+		return t.transport
+	}
+	xlog.Default.Info(xlog.InfoLogFormat(ctx, "Transport.reload", "certificate files changed, transport reloaded"))
+	old.CloseIdleConnections()
+
+	return t.transport
+}
+
+func (t *Transport) files() []string {
+	files := []string{}
+	for _, file := range []string{t.config.TLS.CAFile, t.config.TLS.CertFile, t.config.TLS.KeyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+func (t *Transport) changed() bool {
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return true
+		}
+
+		if stamp := t.stamps[file]; !stamp.modTime.Equal(info.ModTime()) || stamp.size != info.Size() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reload builds transport from config
+func (t *Transport) reload() error {
+	stamps := map[string]fileStamp{}
+	for _, file := range t.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		stamps[file] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	tlsConfig, err := newTLSConfig(t.config.TLS)
+	if err != nil {
+		return err
+	}
+
+	proxy, err := proxyFunc(t.config.Proxy)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	transport.MaxIdleConnsPerHost = t.config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = t.config.IdleConnTimeout
+	// see RoundTrip
+	transport.DisableCompression = true
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: t.config.KeepAlive,
+	}
+	transport.DialContext = countDialer(dialer.DialContext)
+	if t.config.UnixSocket != "" {
+		// requests are forwarded by local socket, proxy is not used
+		transport.Proxy = nil
+		transport.DialContext = countDialer(unixDialer(dialer, t.config.UnixSocket))
+	}
+
+	if t.config.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	t.transport = transport
+	t.stamps = stamps
+	t.checkedAt = time.Now()
+
+	return nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// countDialer counts connections dialed by dial
+func countDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			httpConnections.Inc(addr)
+		}
+		return conn, err
+	}
+}
+
+// newTLSConfig returns nil if no option is set
+func newTLSConfig(c config.TLSConfig) (*tls.Config, error) {
+	if c == (config.TLSConfig{}) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: c.ServerName,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("bad TLS min version %s", c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if c.CAFile != "" {
+		bs, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("both cert file and key file should be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/baidu/conf-agent/config"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	// keyPEM is the PEM of private key
+	keyPEM []byte
+}
+
+// newTestCert issues a certificate by parent, it's self-signed if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert:   cert,
+		key:    key,
+		pem:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, file string, content []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	serverCert := newTestCert(t, "conf.example", ca)
+	trustedClient := newTestCert(t, "agent", ca)
+	untrustedClient := newTestCert(t, "agent", newTestCert(t, "other-ca", nil))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.cert.Raw}, PrivateKey: serverCert.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	c := config.HTTPClientConfig{
+		TLS: config.TLSConfig{
+			CAFile:     filepath.Join(dir, "ca.pem"),
+			CertFile:   filepath.Join(dir, "client.pem"),
+			KeyFile:    filepath.Join(dir, "client.key"),
+			ServerName: "conf.example",
+			MinVersion: "1.2",
+		},
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeTestFile(t, c.TLS.CAFile, ca.pem, modTime)
+	writeTestFile(t, c.TLS.CertFile, untrustedClient.pem, modTime)
+	writeTestFile(t, c.TLS.KeyFile, untrustedClient.keyPEM, modTime)
+
+	transport, err := GetTransport(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared, _ := GetTransport(c); shared != transport {
+		t.Errorf("transport of the same config should be shared")
+	}
+
+	get := func() error {
+		return NewHTTPRequest().Decorate(
+			SimpleRequestOp(http.MethodGet, server.URL, nil),
+			HTTPRequestTransportOp(transport)).
+			Do().
+			Decorate(RspBodyRawReaderOp, RspCode200Op).
+			Err()
+	}
+
+	if err := get(); err == nil {
+		t.Fatalf("want error when client certificate is not trusted")
+	}
+
+	// replace client certificate on disk
+	writeTestFile(t, c.TLS.CertFile, trustedClient.pem, time.Now())
+	writeTestFile(t, c.TLS.KeyFile, trustedClient.keyPEM, time.Now())
+	transport.lock.Lock()
+	transport.checkedAt = time.Time{}
+	transport.lock.Unlock()
+
+	if err := get(); err != nil {
+		t.Fatalf("request after certificate reload fail: %v", err)
+	}
+
+	// a broken file keeps the old transport
+	writeTestFile(t, c.TLS.KeyFile, []byte("half written"), time.Now().Add(time.Minute))
+	transport.lock.Lock()
+	transport.checkedAt = time.Time{}
+	transport.lock.Unlock()
+
+	if err := get(); err != nil {
+		t.Fatalf("request with broken key file fail: %v", err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if c, err := newTLSConfig(config.TLSConfig{}); c != nil || err != nil {
+		t.Errorf("newTLSConfig of zero config = %v, %v, want nil", c, err)
+	}
+
+	if _, err := newTLSConfig(config.TLSConfig{MinVersion: "2.0"}); err == nil {
+		t.Errorf("want error of bad min version")
+	}
+
+	if _, err := newTLSConfig(config.TLSConfig{CertFile: "client.pem"}); err == nil {
+		t.Errorf("want error when key file is not set")
+	}
+
+	c, err := newTLSConfig(config.TLSConfig{ServerName: "conf.example", MinVersion: "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerName != "conf.example" || c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("newTLSConfig = %s %x", c.ServerName, c.MinVersion)
+	}
+}
+
+func TestTransportReuseConnections(t *testing.T) {
+	var lock sync.Mutex
+	conns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			conns++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	transport, err := GetTransport(config.HTTPClientConfig{MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				err := NewHTTPRequest().Decorate(
+					SimpleRequestOp(http.MethodGet, server.URL, nil),
+					HTTPRequestTransportOp(transport),
+					HTTPRequestTimeoutOp(time.Second)).
+					Do().
+					Decorate(RspBodyRawReaderOp, RspCode200Op).
+					Err()
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if conns > 4 {
+		t.Errorf("%d connections for 40 requests, want at most 4", conns)
+	}
+}
+
+func TestHTTPRequestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	req := NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, server.URL+"/slow", nil),
+		HTTPRequestTimeoutOp(50*time.Millisecond)).
+		Do()
+	if req.Err() == nil {
+		t.Errorf("want error of timeout")
+	}
+
+	// body is readable after Do returns
+	req = NewHTTPRequest().Decorate(
+		SimpleRequestOp(http.MethodGet, server.URL, nil),
+		HTTPRequestTimeoutOp(time.Second)).
+		Do().
+		Decorate(RspBodyRawReaderOp, RspCode200Op)
+	if err := req.Err(); err != nil || string(req.RawContent) != "ok" {
+		t.Errorf("response = %s, err: %v", req.RawContent, err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 The BFE Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xhttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Validator is the cache validator of a response, see RFC 7232
+type Validator struct {
+	ETag         string
+	LastModified string
+}
+
+func (v Validator) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
+
+// Validator returns validator of response, zero if no response
+func (hr *HTTPRequest) Validator() Validator {
+	if hr.Response == nil {
+		return Validator{}
+	}
+
+	return Validator{
+		ETag:         hr.Response.Header.Get("ETag"),
+		LastModified: hr.Response.Header.Get("Last-Modified"),
+	}
+}
+
+// NotModified returns true if server replies 304
+func (hr *HTTPRequest) NotModified() bool {
+	return hr.Response != nil && hr.Response.StatusCode == http.StatusNotModified
+}
+
+// ConditionalRequestOp sends If-None-Match and If-Modified-Since with validator
+func ConditionalRequestOp(v Validator) HTTPRequestOp {
+	return func(hr *HTTPRequest) error {
+		if v.ETag != "" {
+			hr.Request.Header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" {
+			hr.Request.Header.Set("If-Modified-Since", v.LastModified)
+		}
+		return nil
+	}
+}
+
+func RspCode200Or304Op(h *HTTPRequest) error {
+	if statusCode := h.Response.StatusCode; statusCode != http.StatusOK && statusCode != http.StatusNotModified {
+		return fmt.Errorf("bad StatuCode: %d, Raw: %s", statusCode, h.RawContent)
+	}
+	return nil
+}
+
+// ValidatorCache remembers validators by url.
+// Only the latest url of a path is kept, as query of conf API changes with local version.
+type ValidatorCache struct {
+	lock       sync.Mutex
+	validators map[string]*urlValidator
+}
+
+type urlValidator struct {
+	url       string
+	validator Validator
+}
+
+func NewValidatorCache() *ValidatorCache {
+	return &ValidatorCache{
+		validators: map[string]*urlValidator{},
+	}
+}
+
+// urlPath removes query of rawURL
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.RawQuery = ""
+	return u.String()
+}
+
+// Get returns validator of rawURL, zero if not exist
+func (cache *ValidatorCache) Get(rawURL string) Validator {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	uv, ok := cache.validators[urlPath(rawURL)]
+	if !ok || uv.url != rawURL {
+		return Validator{}
+	}
+
+	return uv.validator
+}
+
+// Set remembers validator of rawURL, zero validator removes it
+func (cache *ValidatorCache) Set(rawURL string, v Validator) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key := urlPath(rawURL)
+	if v.IsZero() {
+		delete(cache.validators, key)
+		return
+	}
+
+	cache.validators[key] = &urlValidator{
+		url:       rawURL,
+		validator: v,
+	}
+}
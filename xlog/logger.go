@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/baidu/conf-agent/config"
@@ -45,6 +46,13 @@ func Init(c *config.LoggerConfig) error {
 	return nil
 }
 
+// Close flushes and closes the default logger
+func Close() {
+	if closer, ok := Default.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
 var Default Logger = &fakeLogger{}
 
 type fakeLogger struct{}
@@ -77,10 +85,18 @@ func (fl *fakeLogger) Error(arg0 interface{}, args ...interface{}) error {
 	return nil
 }
 
-var ran = rand.NewSource(time.Now().Unix())
+var (
+	// ran is not safe for concurrent use, it's guarded by ranLock
+	ran     = rand.NewSource(time.Now().Unix())
+	ranLock sync.Mutex
+)
 
 var RandomLogID = func() string {
-	return fmt.Sprintf("%d_%03d", time.Now().UnixNano(), ran.Int63()%1000)
+	ranLock.Lock()
+	n := ran.Int63()
+	ranLock.Unlock()
+
+	return fmt.Sprintf("%d_%03d", time.Now().UnixNano(), n%1000)
 }
 
 type logCtx string
@@ -112,6 +128,16 @@ func getLogContext(ctx context.Context) *LogContext {
 	return id.(*LogContext)
 }
 
+// GetLogContext returns LogID and reloader name carried by ctx, they are empty if not exist
+func GetLogContext(ctx context.Context) LogContext {
+	return *getLogContext(ctx)
+}
+
+// ReloaderName returns the reloader name carried by ctx
+func ReloaderName(ctx context.Context) string {
+	return getLogContext(ctx).ReloaderName
+}
+
 func ErrLogFormat(ctx context.Context, topic string, err error) string {
 	logCtx := getLogContext(ctx)
 	return fmt.Sprintf("[%s] module[%16s] topic[%s] err[%v]", logCtx.LogID, logCtx.ReloaderName, topic, err)